@@ -0,0 +1,432 @@
+// Package api exposes a logged in Wechat as an HTTP API.
+//
+// The endpoints are:
+//
+//	POST /send      Sends a text message, from a JSON body
+//	                {"to": "name", "text": "hi"}, or a file, from a
+//	                multipart form with "to", "file" and an optional "type"
+//	                of image, video, emoticon or file.
+//	GET  /contacts  Lists the contacts. "type" filters by friend, group,
+//	                official or special.
+//	GET  /messages  Returns the messages after "since", waiting up to
+//	                "timeout" for one to arrive. With "Accept:
+//	                text/event-stream", streams them as server-sent events.
+//	GET  /status    Reports the logged in user and counters.
+//	GET  /search    Searches Server.Archive by "contact", "group", "since"
+//	                and "until" in RFC 3339, "text" and "limit".
+//
+// "to" is a user name, remark name, nickname or alias. Requests need an
+// "Authorization: Bearer <token>" header if Server.Token is set.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huangw5/webwx/archive"
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
+)
+
+const (
+	// maxBuffered is how many messages are kept for /messages.
+	maxBuffered = 1000
+	// defaultTimeout and maxTimeout bound the long poll of /messages.
+	defaultTimeout = 30 * time.Second
+	maxTimeout     = 5 * time.Minute
+	// maxUploadMemory is how much of an upload is kept in memory.
+	maxUploadMemory = 32 << 20
+	// maxSendBody caps the JSON body of /send.
+	maxSendBody = 1 << 20
+)
+
+// Message is a message as returned by /messages.
+type Message struct {
+	// Seq increases by one for each message. Pass the last seen one as
+	// "since" to get the following messages.
+	Seq  int64  `json:"seq"`
+	Text string `json:"text"`
+	*wechat.AddMsg
+}
+
+// Server serves the API. Create it with NewServer.
+type Server struct {
+	// Wechat must be logged in.
+	Wechat *wechat.Wechat
+	// Token, if set, is the bearer token required on every request.
+	Token string
+	// Archive, if set, is searched by /search.
+	Archive *archive.Archive
+
+	mux     *http.ServeMux
+	started time.Time
+
+	mu       sync.Mutex
+	seq      int64
+	messages []*Message
+	sent     int
+	// arrived is closed and replaced when a message is published.
+	arrived chan struct{}
+}
+
+// NewServer returns a Server for w.
+func NewServer(w *wechat.Wechat, token string) *Server {
+	s := &Server{
+		Wechat:  w,
+		Token:   token,
+		mux:     http.NewServeMux(),
+		started: time.Now(),
+		arrived: make(chan struct{}),
+	}
+	s.mux.HandleFunc("/send", s.handleSend)
+	s.mux.HandleFunc("/contacts", s.handleContacts)
+	s.mux.HandleFunc("/messages", s.handleMessages)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/search", s.handleSearch)
+	return s
+}
+
+// Publish makes msg available to /messages.
+func (s *Server) Publish(msg *wechat.AddMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.messages = append(s.messages, &Message{Seq: s.seq, Text: notify.Describe(msg), AddMsg: msg})
+	if len(s.messages) > maxBuffered {
+		s.messages = s.messages[len(s.messages)-maxBuffered:]
+	}
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+}
+
+// since returns the buffered messages after seq, and a channel that is
+// closed when more arrive.
+func (s *Server) since(seq int64) ([]*Message, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*Message
+	for _, m := range s.messages {
+		if m.Seq > seq {
+			res = append(res, m)
+		}
+	}
+	return res, s.arrived
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing bearer token"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	glog.Infof("Serving API on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+type sendRequest struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		s.sendFile(w, r)
+		return
+	}
+	req := &sendRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSendBody)).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error on decoding body: %v", err))
+		return
+	}
+	if req.Text == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing text"))
+		return
+	}
+	contacts := s.contacts(w)
+	if contacts == nil {
+		return
+	}
+	to, err := contacts.Lookup(req.To)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	err = s.Wechat.SendMsgContext(r.Context(), &wechat.Msg{Type: wechat.MsgTypeText, Content: req.Text, ToUserName: to.UserName})
+	s.sendDone(w, to, err)
+}
+
+func (s *Server) sendFile(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error on parsing form: %v", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	contacts := s.contacts(w)
+	if contacts == nil {
+		return
+	}
+	to, err := contacts.Lookup(r.FormValue("to"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error on reading file: %v", err))
+		return
+	}
+	defer f.Close()
+	u := &wechat.Upload{Reader: f, Size: fh.Size, Name: fh.Filename, ToUserName: to.UserName}
+	send := map[string]func(context.Context, *wechat.Upload) error{
+		"image":    s.Wechat.SendImageContext,
+		"video":    s.Wechat.SendVideoContext,
+		"emoticon": s.Wechat.SendEmoticonContext,
+		"file":     s.Wechat.SendFileContext,
+	}[fileType(r.FormValue("type"), fh.Filename)]
+	if send == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown type: %s", r.FormValue("type")))
+		return
+	}
+	err = send(r.Context(), u)
+	s.sendDone(w, to, err)
+}
+
+// fileType returns how to send the file name, unless given.
+func fileType(given, name string) string {
+	if given != "" {
+		return given
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".bmp":
+		return "image"
+	case ".gif":
+		return "emoticon"
+	case ".mp4":
+		return "video"
+	}
+	return "file"
+}
+
+func (s *Server) sendDone(w http.ResponseWriter, to *wechat.Member, err error) {
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	s.mu.Lock()
+	s.sent++
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]string{"to": to.UserName})
+}
+
+// contacts returns the contacts of the login, or writes 503 and returns nil
+// before the first login.
+func (s *Server) contacts(w http.ResponseWriter) *wechat.ContactBook {
+	c := s.Wechat.Contacts
+	if c == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Errorf("not logged in"))
+	}
+	return c
+}
+
+func (s *Server) handleContacts(w http.ResponseWriter, r *http.Request) {
+	var types []wechat.ContactType
+	if t := r.FormValue("type"); t != "" {
+		for _, ct := range []wechat.ContactType{wechat.ContactFriend, wechat.ContactGroup, wechat.ContactOfficial, wechat.ContactSpecial} {
+			if ct.String() == t {
+				types = append(types, ct)
+			}
+		}
+		if len(types) == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown type: %s", t))
+			return
+		}
+	}
+	contacts := s.contacts(w)
+	if contacts == nil {
+		return
+	}
+	members := contacts.Members(types...)
+	if members == nil {
+		members = []*wechat.Member{}
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	if err != nil && r.FormValue("since") != "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since: %v", err))
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since, _ = strconv.ParseInt(id, 10, 64)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.stream(w, r, since)
+		return
+	}
+	timeout := defaultTimeout
+	if t := r.FormValue("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %v", err))
+			return
+		}
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		msgs, arrived := s.since(since)
+		if len(msgs) > 0 {
+			writeJSON(w, http.StatusOK, msgs)
+			return
+		}
+		select {
+		case <-arrived:
+		case <-timer.C:
+			writeJSON(w, http.StatusOK, []*Message{})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// stream sends the messages after since as server-sent events until the
+// client goes away.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		msgs, arrived := s.since(since)
+		for _, m := range msgs {
+			b, err := json.Marshal(m)
+			if err != nil {
+				glog.Warningf("Failed to marshal message: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.Seq, b)
+			since = m.Seq
+		}
+		flusher.Flush()
+		select {
+		case <-arrived:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type status struct {
+	UserName string    `json:"user_name"`
+	NickName string    `json:"nick_name"`
+	Contacts int       `json:"contacts"`
+	Received int64     `json:"received"`
+	Sent     int       `json:"sent"`
+	Started  time.Time `json:"started"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	st := &status{Started: s.started}
+	if u := s.Wechat.CurrentUser(); u != nil {
+		st.UserName = u.UserName
+		st.NickName = u.NickName
+	}
+	if s.Wechat.Contacts != nil {
+		st.Contacts = s.Wechat.Contacts.Len()
+	}
+	s.mu.Lock()
+	st.Received = s.seq
+	st.Sent = s.sent
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if s.Archive == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no archive"))
+		return
+	}
+	q := &archive.Query{
+		Contact: r.FormValue("contact"),
+		Group:   r.FormValue("group"),
+		Text:    r.FormValue("text"),
+		Limit:   100,
+	}
+	var err error
+	if l := r.FormValue("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %v", err))
+			return
+		}
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := r.FormValue(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %v", name, err))
+				return
+			}
+		}
+	}
+	res, err := s.Archive.Search(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if res == nil {
+		res = []*archive.Record{}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("Failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	glog.Warningf("API error: %v", err)
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/archive"
+	"github.com/huangw5/webwx/wechat"
+)
+
+// fakeClient records the requests to the WeChat server and succeeds.
+type fakeClient struct {
+	urls   []string
+	bodies []string
+}
+
+func (c *fakeClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	b, _ := ioutil.ReadAll(body)
+	c.urls = append(c.urls, url)
+	c.bodies = append(c.bodies, string(b))
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(`{"BaseResponse": {"Ret": 0}}`)),
+	}, nil
+}
+
+func newTestServer(token string) (*Server, *fakeClient) {
+	c := &fakeClient{}
+	w := &wechat.Wechat{
+		Client: c,
+		Contacts: wechat.NewContactBook([]*wechat.Member{
+			{UserName: "@a", NickName: "Alice"},
+			{UserName: "@@g", NickName: "Group"},
+		}),
+	}
+	w.SetSession(nil, &wechat.BaseRequestJSON{BaseRequest: &wechat.BaseRequest{}}, &wechat.Member{UserName: "@me", NickName: "Me"})
+	return NewServer(w, token), c
+}
+
+func TestAuth(t *testing.T) {
+	s, _ := newTestServer("secret")
+	for _, tt := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("GET /status with %q = %d, want %d", tt.auth, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	s, c := newTestServer("")
+	r := httptest.NewRequest("POST", "/send", strings.NewReader(`{"to": "Alice", "text": "hello"}`))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /send = %d: %s", rec.Code, rec.Body)
+	}
+	if len(c.urls) != 1 || !strings.Contains(c.urls[0], "webwxsendmsg") {
+		t.Fatalf("requests = %v, want webwxsendmsg", c.urls)
+	}
+	if !strings.Contains(c.bodies[0], `"ToUserName":"@a"`) || !strings.Contains(c.bodies[0], `"Content":"hello"`) {
+		t.Errorf("body = %s", c.bodies[0])
+	}
+
+	r = httptest.NewRequest("POST", "/send", strings.NewReader(`{"to": "Bob", "text": "hello"}`))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST /send to unknown = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	big := `{"to": "Alice", "text": "` + strings.Repeat("x", maxSendBody) + `"}`
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/send", strings.NewReader(big)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /send of %d bytes = %d, want %d", len(big), rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestNotLoggedIn(t *testing.T) {
+	s, c := newTestServer("")
+	s.Wechat.Contacts = nil
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/send", strings.NewReader(`{"to": "Alice", "text": "hello"}`)),
+		httptest.NewRequest("GET", "/contacts", nil),
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s before the login = %d, want %d", r.Method, r.URL, rec.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if len(c.urls) != 0 {
+		t.Errorf("requests = %v, want none", c.urls)
+	}
+}
+
+func TestContacts(t *testing.T) {
+	s, _ := newTestServer("")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/contacts?type=group", nil))
+	var got []*wechat.Member
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", rec.Body, err)
+	}
+	if len(got) != 1 || got[0].UserName != "@@g" {
+		t.Errorf("GET /contacts?type=group = %s", rec.Body)
+	}
+}
+
+func TestMessagesLongPoll(t *testing.T) {
+	s, _ := newTestServer("")
+	s.Publish(&wechat.AddMsg{MsgID: "1", MsgType: wechat.MsgTypeText, Content: "one"})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/messages", nil))
+	var got []*Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", rec.Body, err)
+	}
+	if len(got) != 1 || got[0].Seq != 1 || got[0].Text != "one" {
+		t.Fatalf("GET /messages = %s", rec.Body)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/messages?since=1&timeout=10s", nil))
+		done <- rec
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Publish(&wechat.AddMsg{MsgID: "2", MsgType: wechat.MsgTypeText, Content: "two"})
+	select {
+	case rec := <-done:
+		got = nil
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", rec.Body, err)
+		}
+		if len(got) != 1 || got[0].Seq != 2 {
+			t.Errorf("GET /messages?since=1 = %s", rec.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll did not return")
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/messages?since=2&timeout=1ms", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Errorf("GET /messages after timeout = %s, want []", got)
+	}
+}
+
+func TestMessagesSSE(t *testing.T) {
+	s, _ := newTestServer("")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	s.Publish(&wechat.AddMsg{MsgID: "1", MsgType: wechat.MsgTypeText, Content: "one"})
+
+	req, _ := http.NewRequest("GET", srv.URL+"/messages", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString: %v", err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if lines[0] != "id: 1" || lines[1] != "event: message" || !strings.HasPrefix(lines[2], "data: ") {
+		t.Errorf("events = %q", lines)
+	}
+	m := &Message{}
+	if err := json.NewDecoder(bytes.NewReader([]byte(strings.TrimPrefix(lines[2], "data: ")))).Decode(m); err != nil || m.MsgID != "1" {
+		t.Errorf("data = %s, %v", lines[2], err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s, _ := newTestServer("")
+	a, err := archive.Open(filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	s.Archive = a
+	a.Add(&wechat.AddMsg{MsgID: "1", CreateTime: 1000, FromUserName: "@a", SenderUserName: "@a", NickName: "Alice"}, "hello")
+	a.Add(&wechat.AddMsg{MsgID: "2", CreateTime: 2000, FromUserName: "@b", SenderUserName: "@b", NickName: "Bob"}, "hello")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/search?contact=Bob&text=hello", nil))
+	var got []*archive.Record
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", rec.Body, err)
+	}
+	if len(got) != 1 || got[0].Msg.MsgID != "2" {
+		t.Errorf("GET /search = %s", rec.Body)
+	}
+}
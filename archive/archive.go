@@ -0,0 +1,445 @@
+// Package archive stores WeChat messages and contacts in a local bbolt
+// database and searches them.
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/huangw5/webwx/wechat"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// messagesBucket maps CreateTime and MsgID to a Record, so that keys are
+	// in time order.
+	messagesBucket = []byte("messages")
+	// idsBucket maps MsgID to the key in messagesBucket.
+	idsBucket = []byte("ids")
+	// contactsBucket maps UserName to the latest Member.
+	contactsBucket = []byte("contacts")
+	// chatsBucket indexes messagesBucket by the UserNames of each message:
+	// UserName, 0, key in messagesBucket.
+	chatsBucket = []byte("chats")
+	// namesBucket maps the lower case names of contacts to every UserName
+	// they had: name, 0, UserName. UserNames change on each login, while
+	// names stay, so searching by name finds the messages of older logins.
+	namesBucket = []byte("names")
+)
+
+// Record is an archived message.
+type Record struct {
+	Msg *wechat.AddMsg `json:"msg"`
+	// Text is the message as human readable text.
+	Text string `json:"text"`
+	// MediaPath is where the image, voice or video of the message was
+	// saved, if any.
+	MediaPath string `json:"media_path,omitempty"`
+	// Archived is when the message was archived.
+	Archived time.Time `json:"archived"`
+}
+
+// Time returns when the message was sent.
+func (r *Record) Time() time.Time {
+	if r.Msg.CreateTime == 0 {
+		return r.Archived
+	}
+	return time.Unix(r.Msg.CreateTime, 0)
+}
+
+// Archive is a message archive. It is safe for concurrent use.
+type Archive struct {
+	db *bolt.DB
+}
+
+// Open opens the archive at path, creating it if needed.
+func Open(path string) (*Archive, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error on opening %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Archives from before the indexes get them on the first open.
+		reindex := tx.Bucket(chatsBucket) == nil
+		for _, b := range [][]byte{messagesBucket, idsBucket, contactsBucket, chatsBucket, namesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if reindex {
+			return index(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error on creating buckets: %v", err)
+	}
+	return &Archive{db: db}, nil
+}
+
+// OpenReadOnly opens the existing archive at path for reading, e.g. to
+// search it from another process. bbolt locks the file while it is open for
+// writing, so this fails while webwx is running with the archive; search
+// with the /search endpoint of the API then.
+func OpenReadOnly(path string) (*Archive, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use, e.g. by a running webwx; search with the /search endpoint of its API instead", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error on opening %s: %v", path, err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{messagesBucket, idsBucket, contactsBucket} {
+			if tx.Bucket(b) == nil {
+				return fmt.Errorf("%s is not an archive", path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Archive{db: db}, nil
+}
+
+// index fills chatsBucket and namesBucket from the messages and contacts.
+func index(tx *bolt.Tx) error {
+	err := tx.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		r := &Record{}
+		if err := json.Unmarshal(v, r); err != nil {
+			return fmt.Errorf("error on unmarshal %q: %v", k, err)
+		}
+		return indexMsg(tx, r.Msg, k)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(contactsBucket).ForEach(func(k, v []byte) error {
+		m := &wechat.Member{}
+		if err := json.Unmarshal(v, m); err != nil {
+			return fmt.Errorf("error on unmarshal %q: %v", k, err)
+		}
+		return indexNames(tx, m.UserName, m.NickName, m.RemarkName, m.Alias)
+	})
+}
+
+// indexMsg adds msg, stored at key k, to the indexes.
+func indexMsg(tx *bolt.Tx, msg *wechat.AddMsg, k []byte) error {
+	chats := tx.Bucket(chatsBucket)
+	for _, u := range []string{msg.FromUserName, msg.ToUserName, msg.SenderUserName} {
+		if u == "" {
+			continue
+		}
+		if err := chats.Put(indexKey(u, k), []byte{}); err != nil {
+			return err
+		}
+	}
+	if err := indexNames(tx, msg.SenderUserName, msg.NickName); err != nil {
+		return err
+	}
+	if strings.HasPrefix(msg.FromUserName, "@@") {
+		return indexNames(tx, msg.FromUserName, msg.GroupNickName)
+	}
+	return nil
+}
+
+// indexNames records that userName goes by names.
+func indexNames(tx *bolt.Tx, userName string, names ...string) error {
+	if userName == "" {
+		return nil
+	}
+	b := tx.Bucket(namesBucket)
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if err := b.Put(indexKey(strings.ToLower(n), []byte(userName)), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexKey(prefix string, k []byte) []byte {
+	return append([]byte(prefix+"\x00"), k...)
+}
+
+// Close closes the archive.
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+func messageKey(t time.Time, msgID string) []byte {
+	k := make([]byte, 8, 8+len(msgID))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, msgID...)
+}
+
+// Add archives msg with its human readable text. Messages already archived
+// are skipped.
+func (a *Archive) Add(msg *wechat.AddMsg, text string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(idsBucket)
+		if ids.Get([]byte(msg.MsgID)) != nil {
+			return nil
+		}
+		r := &Record{Msg: msg, Text: text, Archived: time.Now()}
+		v, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal: %v", err)
+		}
+		k := messageKey(r.Time(), msg.MsgID)
+		if err := tx.Bucket(messagesBucket).Put(k, v); err != nil {
+			return err
+		}
+		if err := indexMsg(tx, msg, k); err != nil {
+			return err
+		}
+		return ids.Put([]byte(msg.MsgID), k)
+	})
+}
+
+// Get returns the archived message with the given MsgID, or nil.
+func (a *Archive) Get(msgID string) (*Record, error) {
+	var r *Record
+	err := a.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket(idsBucket).Get([]byte(msgID))
+		if k == nil {
+			return nil
+		}
+		r = &Record{}
+		return json.Unmarshal(tx.Bucket(messagesBucket).Get(k), r)
+	})
+	return r, err
+}
+
+// SetMediaPath records where the media of the given message was saved.
+func (a *Archive) SetMediaPath(msgID, path string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		k := tx.Bucket(idsBucket).Get([]byte(msgID))
+		if k == nil {
+			return fmt.Errorf("message %s not archived", msgID)
+		}
+		msgs := tx.Bucket(messagesBucket)
+		r := &Record{}
+		if err := json.Unmarshal(msgs.Get(k), r); err != nil {
+			return fmt.Errorf("error on unmarshal: %v", err)
+		}
+		r.MediaPath = path
+		v, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal: %v", err)
+		}
+		return msgs.Put(k, v)
+	})
+}
+
+// SaveContacts stores a snapshot of members, replacing earlier snapshots of
+// the same contacts.
+func (a *Archive) SaveContacts(members []*wechat.Member) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(contactsBucket)
+		for _, m := range members {
+			v, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Errorf("failed to marshal: %v", err)
+			}
+			if err := b.Put([]byte(m.UserName), v); err != nil {
+				return err
+			}
+			if err := indexNames(tx, m.UserName, m.NickName, m.RemarkName, m.Alias); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Contact returns the latest snapshot of the contact, or nil.
+func (a *Archive) Contact(userName string) (*wechat.Member, error) {
+	var m *wechat.Member
+	err := a.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(contactsBucket).Get([]byte(userName))
+		if v == nil {
+			return nil
+		}
+		m = &wechat.Member{}
+		return json.Unmarshal(v, m)
+	})
+	return m, err
+}
+
+// Query selects archived messages. Empty fields match everything.
+type Query struct {
+	// Contact is the nickname, remark name, alias or user name of the
+	// contact, case insensitive. It matches the messages sent to the
+	// contact as well as by it, including those of older logins.
+	Contact string
+	// Group is the nickname or user name of the group, case insensitive.
+	Group string
+	// Since and Until bound the time the messages were sent. Until is
+	// exclusive.
+	Since, Until time.Time
+	// Text holds words that must all appear in the text, case insensitive.
+	Text string
+	// Limit is the max number of results. The latest ones are returned.
+	Limit int
+}
+
+// Search returns the messages matching q, oldest first.
+func (a *Archive) Search(q *Query) ([]*Record, error) {
+	words := strings.Fields(strings.ToLower(q.Text))
+	var res []*Record
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var users map[string]bool
+		if q.Contact != "" {
+			var err error
+			if users, err = q.users(tx); err != nil {
+				return err
+			}
+		}
+		msgs := tx.Bucket(messagesBucket)
+		add := func(k, v []byte) (bool, error) {
+			r := &Record{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return false, fmt.Errorf("error on unmarshal %q: %v", k, err)
+			}
+			if q.matches(r, words, users) {
+				res = append(res, r)
+			}
+			return q.Limit > 0 && len(res) >= q.Limit, nil
+		}
+		if users != nil && tx.Bucket(chatsBucket) != nil {
+			for _, k := range q.chatKeys(tx, users) {
+				if done, err := add(k, msgs.Get(k)); done || err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		c := msgs.Cursor()
+		var k, v []byte
+		if q.Until.IsZero() {
+			k, v = c.Last()
+		} else {
+			k, v = c.Seek(messageKey(q.Until, ""))
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+		since := messageKey(q.Since, "")
+		for ; k != nil; k, v = c.Prev() {
+			if !q.Since.IsZero() && bytes.Compare(k, since) < 0 {
+				break
+			}
+			if done, err := add(k, v); done || err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Reverse to oldest first.
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+// users returns the UserNames q.Contact had. Archives opened read-only from
+// before namesBucket fall back to the contacts.
+func (q *Query) users(tx *bolt.Tx) (map[string]bool, error) {
+	users := map[string]bool{q.Contact: true}
+	if names := tx.Bucket(namesBucket); names != nil {
+		prefix := indexKey(strings.ToLower(q.Contact), nil)
+		c := names.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			users[string(k[len(prefix):])] = true
+		}
+		return users, nil
+	}
+	err := tx.Bucket(contactsBucket).ForEach(func(k, v []byte) error {
+		m := &wechat.Member{}
+		if err := json.Unmarshal(v, m); err != nil {
+			return fmt.Errorf("error on unmarshal %q: %v", k, err)
+		}
+		if equalAny(q.Contact, m.NickName, m.RemarkName, m.Alias) {
+			users[m.UserName] = true
+		}
+		return nil
+	})
+	return users, err
+}
+
+// chatKeys returns the keys of the messages of users between q.Since and
+// q.Until, latest first.
+func (q *Query) chatKeys(tx *bolt.Tx, users map[string]bool) [][]byte {
+	seen := make(map[string]bool)
+	var keys [][]byte
+	c := tx.Bucket(chatsBucket).Cursor()
+	for u := range users {
+		prefix := indexKey(u, nil)
+		start := prefix
+		if !q.Since.IsZero() {
+			start = indexKey(u, messageKey(q.Since, ""))
+		}
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			mk := k[len(prefix):]
+			if !q.Until.IsZero() && bytes.Compare(mk, messageKey(q.Until, "")) >= 0 {
+				break
+			}
+			if !seen[string(mk)] {
+				seen[string(mk)] = true
+				keys = append(keys, append([]byte(nil), mk...))
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) > 0 })
+	return keys
+}
+
+// matches returns whether r matches q. users, if not nil, are the
+// UserNames of q.Contact.
+func (q *Query) matches(r *Record, words []string, users map[string]bool) bool {
+	msg := r.Msg
+	if q.Group != "" {
+		group := msg.FromUserName
+		if !strings.HasPrefix(group, "@@") {
+			group = msg.ToUserName
+		}
+		if !strings.HasPrefix(group, "@@") || !equalAny(q.Group, msg.GroupNickName, group) {
+			return false
+		}
+	}
+	if users != nil && !users[msg.FromUserName] && !users[msg.ToUserName] && !users[msg.SenderUserName] && !equalAny(q.Contact, msg.NickName) {
+		return false
+	}
+	text := strings.ToLower(r.Text)
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalAny(s string, names ...string) bool {
+	for _, n := range names {
+		if n != "" && strings.EqualFold(s, n) {
+			return true
+		}
+	}
+	return false
+}
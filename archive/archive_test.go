@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+func newTestArchive(t *testing.T) *Archive {
+	a, err := Open(filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestSearch(t *testing.T) {
+	a := newTestArchive(t)
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []struct {
+		msg  *wechat.AddMsg
+		text string
+	}{
+		{&wechat.AddMsg{MsgID: "1", CreateTime: base.Unix(), FromUserName: "@a", SenderUserName: "@a", NickName: "Alice"}, "Hello world"},
+		{&wechat.AddMsg{MsgID: "2", CreateTime: base.Add(time.Hour).Unix(), FromUserName: "@@g", SenderUserName: "@b", NickName: "Bob", GroupNickName: "Team"}, "the world is round"},
+		{&wechat.AddMsg{MsgID: "3", CreateTime: base.Add(2 * time.Hour).Unix(), FromUserName: "@a", SenderUserName: "@a", NickName: "Alice"}, "bye"},
+	}
+	for _, m := range msgs {
+		if err := a.Add(m.msg, m.text); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	// Duplicates are skipped.
+	if err := a.Add(msgs[0].msg, "again"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := a.SaveContacts([]*wechat.Member{{UserName: "@a", NickName: "Alice", RemarkName: "Ally"}}); err != nil {
+		t.Fatalf("SaveContacts: %v", err)
+	}
+
+	tests := []struct {
+		q    *Query
+		want []string
+	}{
+		{&Query{}, []string{"1", "2", "3"}},
+		{&Query{Contact: "ally"}, []string{"1", "3"}},
+		{&Query{Group: "Team"}, []string{"2"}},
+		{&Query{Text: "WORLD"}, []string{"1", "2"}},
+		{&Query{Text: "world round"}, []string{"2"}},
+		{&Query{Since: base.Add(time.Hour)}, []string{"2", "3"}},
+		{&Query{Until: base.Add(time.Hour)}, []string{"1"}},
+		{&Query{Since: base.Add(time.Hour), Until: base.Add(2 * time.Hour)}, []string{"2"}},
+		{&Query{Limit: 2}, []string{"2", "3"}},
+	}
+	for _, tt := range tests {
+		res, err := a.Search(tt.q)
+		if err != nil {
+			t.Errorf("Search(%+v): %v", tt.q, err)
+			continue
+		}
+		var got []string
+		for _, r := range res {
+			got = append(got, r.Msg.MsgID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Search(%+v) = %v, want %v", tt.q, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Search(%+v) = %v, want %v", tt.q, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchContact(t *testing.T) {
+	a := newTestArchive(t)
+	base := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	add := func(msg *wechat.AddMsg) {
+		if err := a.Add(msg, "text"); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	save := func(m *wechat.Member) {
+		if err := a.SaveContacts([]*wechat.Member{m}); err != nil {
+			t.Fatalf("SaveContacts: %v", err)
+		}
+	}
+	// Sent to Alice, then her reply after logging in again, with new
+	// UserNames.
+	save(&wechat.Member{UserName: "@a1", NickName: "Alice", RemarkName: "Ally"})
+	add(&wechat.AddMsg{MsgID: "1", CreateTime: base.Unix(), FromUserName: "@me1", ToUserName: "@a1", SenderUserName: "@me1"})
+	save(&wechat.Member{UserName: "@a2", NickName: "Alice", RemarkName: "Ally"})
+	add(&wechat.AddMsg{MsgID: "2", CreateTime: base.Add(time.Hour).Unix(), FromUserName: "@a2", ToUserName: "@me2", SenderUserName: "@a2", NickName: "Alice"})
+	add(&wechat.AddMsg{MsgID: "3", CreateTime: base.Add(2 * time.Hour).Unix(), FromUserName: "@b", ToUserName: "@me2", SenderUserName: "@b", NickName: "Bob"})
+
+	for _, tt := range []struct {
+		q    *Query
+		want string
+	}{
+		{&Query{Contact: "ally"}, "1 2"},
+		{&Query{Contact: "Alice", Since: base.Add(time.Hour)}, "2"},
+		{&Query{Contact: "alice", Until: base.Add(time.Hour)}, "1"},
+		{&Query{Contact: "Ally", Limit: 1}, "2"},
+		{&Query{Contact: "@a1"}, "1"},
+		{&Query{Contact: "bob"}, "3"},
+	} {
+		res, err := a.Search(tt.q)
+		if err != nil {
+			t.Errorf("Search(%+v): %v", tt.q, err)
+			continue
+		}
+		var got []string
+		for _, r := range res {
+			got = append(got, r.Msg.MsgID)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("Search(%+v) = %v, want %s", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSetMediaPath(t *testing.T) {
+	a := newTestArchive(t)
+	if err := a.Add(&wechat.AddMsg{MsgID: "1", MsgType: wechat.MsgTypeImage}, "[Image]"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := a.SetMediaPath("1", "/tmp/1.jpg"); err != nil {
+		t.Fatalf("SetMediaPath: %v", err)
+	}
+	r, err := a.Get("1")
+	if err != nil || r == nil || r.MediaPath != "/tmp/1.jpg" {
+		t.Errorf("Get = %+v, %v, want MediaPath /tmp/1.jpg", r, err)
+	}
+	if err := a.SetMediaPath("2", "/tmp/2.jpg"); err == nil {
+		t.Errorf("SetMediaPath of unknown message succeeded")
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := a.Add(&wechat.AddMsg{MsgID: "1", CreateTime: 1}, "hi"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := OpenReadOnly(path); err == nil || !strings.Contains(err.Error(), "/search") {
+		t.Errorf("OpenReadOnly while open for writing returned %v, want the in use error", err)
+	}
+	a.Close()
+
+	r, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %v", err)
+	}
+	defer r.Close()
+	if res, err := r.Search(&Query{}); err != nil || len(res) != 1 {
+		t.Errorf("Search = %v, %v, want the archived message", res, err)
+	}
+	if err := r.Add(&wechat.AddMsg{MsgID: "2"}, "bye"); err == nil {
+		t.Errorf("Add on a read-only archive succeeded, want error")
+	}
+	if _, err := OpenReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Errorf("OpenReadOnly of a missing file succeeded, want error")
+	}
+}
@@ -0,0 +1,259 @@
+// Package autoreply replies to WeChat messages according to rules loaded
+// from a YAML or JSON file. See Config for the format.
+package autoreply
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
+)
+
+// Data is what the reply templates are executed with. The AddMsg fields are
+// available directly, e.g. {{.NickName}}.
+type Data struct {
+	*wechat.AddMsg
+	// Text is the message as human readable text.
+	Text string
+	// Match holds the submatches of Rule.Regex, if any.
+	Match []string
+}
+
+// Engine replies to messages. Create it with NewEngine.
+type Engine struct {
+	Wechat *wechat.Wechat
+	// Path is the rules file.
+	Path string
+
+	mu      sync.Mutex
+	config  *Config
+	modTime time.Time
+	// replied is when each rule last replied to each chat.
+	replied map[string]time.Time
+	now     func() time.Time
+}
+
+// NewEngine returns an Engine for w with the rules in path.
+func NewEngine(w *wechat.Wechat, path string) (*Engine, error) {
+	e := &Engine{Wechat: w, Path: path, replied: make(map[string]time.Time), now: time.Now}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reloads the rules file. The old rules are kept on failure.
+func (e *Engine) Reload() error {
+	fi, err := os.Stat(e.Path)
+	if err != nil {
+		return err
+	}
+	c, err := Load(e.Path)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.config = c
+	e.modTime = fi.ModTime()
+	glog.Infof("Loaded %d auto-reply rules from %s", len(c.Rules), e.Path)
+	return nil
+}
+
+// Watch reloads the rules file whenever it changes, checking every interval
+// until ctx is done.
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			fi, err := os.Stat(e.Path)
+			if err != nil {
+				glog.Warningf("Failed to stat %s: %v", e.Path, err)
+				continue
+			}
+			e.mu.Lock()
+			changed := !fi.ModTime().Equal(e.modTime)
+			e.mu.Unlock()
+			if !changed {
+				continue
+			}
+			if err := e.Reload(); err != nil {
+				glog.Warningf("Failed to reload auto-reply rules: %v", err)
+				// Don't retry until it changes again.
+				e.mu.Lock()
+				e.modTime = fi.ModTime()
+				e.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Handle replies to msg if a rule matches, or if away. It returns whether
+// it replied.
+func (e *Engine) Handle(ctx context.Context, msg *wechat.AddMsg) (bool, error) {
+	if u := e.Wechat.CurrentUser(); u != nil && msg.FromUserName == u.UserName {
+		// Sent by us from another device.
+		return false, nil
+	}
+	text := notify.Describe(msg)
+	e.mu.Lock()
+	c := e.config
+	now := e.now()
+	e.mu.Unlock()
+	away := c.Away != nil && c.Away.away(now)
+
+	for _, r := range c.Rules {
+		match, ok := e.match(r, msg, text, away)
+		if !ok {
+			continue
+		}
+		return e.replyOnce(ctx, r.Name, time.Duration(r.Cooldown), r.reply, &Data{AddMsg: msg, Text: text, Match: match}, now)
+	}
+	if away && !isGroup(msg) && !e.isOfficial(msg) && msg.MsgType != wechat.MsgTypeSys {
+		return e.replyOnce(ctx, "away", time.Duration(c.Away.Cooldown), c.Away.reply, &Data{AddMsg: msg, Text: text}, now)
+	}
+	return false, nil
+}
+
+// replyOnce replies with t unless rule is cooling down for the chat. The
+// cooldown starts before sending, so that concurrent messages reply once,
+// and is rolled back if the reply fails.
+func (e *Engine) replyOnce(ctx context.Context, rule string, cooldown time.Duration, t *template.Template, d *Data, now time.Time) (bool, error) {
+	key := rule + "\x00" + d.FromUserName
+	e.mu.Lock()
+	last, ok := e.replied[key]
+	if ok && now.Sub(last) < cooldown {
+		e.mu.Unlock()
+		glog.Infof("Auto-reply rule %s is cooling down for %s", rule, d.FromUserName)
+		return false, nil
+	}
+	e.replied[key] = now
+	e.mu.Unlock()
+
+	if err := e.reply(ctx, t, d); err != nil {
+		e.mu.Lock()
+		if e.replied[key].Equal(now) {
+			if ok {
+				e.replied[key] = last
+			} else {
+				delete(e.replied, key)
+			}
+		}
+		e.mu.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+func isGroup(msg *wechat.AddMsg) bool {
+	return strings.HasPrefix(msg.FromUserName, "@@")
+}
+
+// isOfficial returns whether msg comes from an official, service or built-in
+// account, which get no away replies.
+func (e *Engine) isOfficial(msg *wechat.AddMsg) bool {
+	if strings.HasPrefix(msg.FromUserName, "gh_") {
+		return true
+	}
+	if e.Wechat.Contacts == nil {
+		return false
+	}
+	m := e.Wechat.Contacts.Get(msg.FromUserName)
+	return m != nil && (m.Type() == wechat.ContactOfficial || m.Type() == wechat.ContactSpecial)
+}
+
+// match returns whether r matches msg, with the submatches of its regex.
+func (e *Engine) match(r *Rule, msg *wechat.AddMsg, text string, away bool) ([]string, bool) {
+	if r.OnlyAway && !away {
+		return nil, false
+	}
+	if isGroup(msg) {
+		if !contains(r.Groups, "*", msg.GroupNickName, msg.FromUserName) {
+			return nil, false
+		}
+	} else if len(r.Groups) > 0 {
+		return nil, false
+	}
+	if len(r.From) > 0 {
+		names := []string{msg.NickName, msg.SenderUserName}
+		if e.Wechat.Contacts != nil {
+			if m := e.Wechat.Contacts.Get(msg.SenderUserName); m != nil {
+				names = append(names, m.RemarkName, m.Alias, m.NickName)
+			}
+		}
+		if !contains(r.From, names...) {
+			return nil, false
+		}
+	}
+	types := r.Types
+	if len(types) == 0 {
+		types = []int{wechat.MsgTypeText}
+	}
+	typeOK := false
+	for _, t := range types {
+		if t == msg.MsgType {
+			typeOK = true
+		}
+	}
+	if !typeOK {
+		return nil, false
+	}
+	if len(r.Keywords) > 0 {
+		lower := strings.ToLower(text)
+		found := false
+		for _, k := range r.Keywords {
+			if strings.Contains(lower, strings.ToLower(k)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	if r.regex != nil {
+		match := r.regex.FindStringSubmatch(text)
+		if match == nil {
+			return nil, false
+		}
+		return match, true
+	}
+	return nil, true
+}
+
+// contains returns whether any of names is in list.
+func contains(list []string, names ...string) bool {
+	for _, l := range list {
+		for _, n := range names {
+			if n != "" && l == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *Engine) reply(ctx context.Context, t *template.Template, d *Data) error {
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		return fmt.Errorf("error on executing template %s: %v", t.Name(), err)
+	}
+	glog.Infof("Auto-replying to %s with rule %s", notify.Sender(d.AddMsg), t.Name())
+	return e.Wechat.SendMsgContext(ctx, &wechat.Msg{
+		Type:       wechat.MsgTypeText,
+		Content:    b.String(),
+		ToUserName: d.FromUserName,
+	})
+}
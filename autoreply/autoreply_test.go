@@ -0,0 +1,231 @@
+package autoreply
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+// fakeClient records the messages sent to the WeChat server.
+type fakeClient struct {
+	mu     sync.Mutex
+	bodies []string
+	// fail makes sending fail.
+	fail bool
+}
+
+func (c *fakeClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	if c.fail {
+		return &http.Response{
+			StatusCode: 200,
+			Status:     "200 OK",
+			Body:       ioutil.NopCloser(strings.NewReader(`{"BaseResponse": {"Ret": 1101}}`)),
+		}, nil
+	}
+	b, _ := ioutil.ReadAll(body)
+	c.mu.Lock()
+	c.bodies = append(c.bodies, string(b))
+	c.mu.Unlock()
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(`{"BaseResponse": {"Ret": 0}}`)),
+	}, nil
+}
+
+const testRules = `
+cooldown: 1m
+away:
+  schedule:
+    - days: [sat]
+      start: "22:00"
+      end: "08:00"
+  reply: "Away, {{.NickName}}"
+rules:
+  - name: ping
+    from: [Ally]
+    regex: "^ping (\\w+)$"
+    reply: "pong {{index .Match 1}}"
+  - name: urgent
+    groups: [Team]
+    keywords: [URGENT]
+    reply: "On it"
+`
+
+func newTestEngine(t *testing.T, rules string) (*Engine, *fakeClient) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClient{}
+	w := &wechat.Wechat{
+		Client: c,
+		Contacts: wechat.NewContactBook([]*wechat.Member{
+			{UserName: "@a", NickName: "Alice", RemarkName: "Ally"},
+			{UserName: "@news", NickName: "News", VerifyFlag: 24},
+		}),
+	}
+	w.SetSession(nil, &wechat.BaseRequestJSON{BaseRequest: &wechat.BaseRequest{}}, &wechat.Member{UserName: "@me"})
+	e, err := NewEngine(w, path)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	// A Wednesday noon.
+	e.now = func() time.Time { return time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local) }
+	return e, c
+}
+
+func TestHandle(t *testing.T) {
+	e, c := newTestEngine(t, testRules)
+	tests := []struct {
+		msg  *wechat.AddMsg
+		want string
+	}{
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@a", SenderUserName: "@a", Content: "ping there"}, "pong there"},
+		// Cooling down.
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@a", SenderUserName: "@a", Content: "ping again"}, ""},
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@b", SenderUserName: "@b", Content: "ping there"}, ""},
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@@g", SenderUserName: "@b", GroupNickName: "Team", Content: "this is urgent"}, "On it"},
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@@h", SenderUserName: "@b", GroupNickName: "Other", Content: "this is urgent"}, ""},
+		{&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@me", SenderUserName: "@me", Content: "ping me"}, ""},
+	}
+	for _, tt := range tests {
+		n := len(c.bodies)
+		replied, err := e.Handle(context.Background(), tt.msg)
+		if err != nil {
+			t.Errorf("Handle(%q): %v", tt.msg.Content, err)
+		}
+		if replied != (tt.want != "") || len(c.bodies) != n+boolToInt(replied) {
+			t.Errorf("Handle(%q) replied = %v, want %q", tt.msg.Content, replied, tt.want)
+			continue
+		}
+		if replied && !strings.Contains(c.bodies[n], `"Content":"`+tt.want+`"`) {
+			t.Errorf("Handle(%q) sent %s, want %q", tt.msg.Content, c.bodies[n], tt.want)
+		}
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestAway(t *testing.T) {
+	e, c := newTestEngine(t, testRules)
+	msg := &wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@b", SenderUserName: "@b", NickName: "Bob", Content: "hi"}
+	for _, tt := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 17, 21, 0, 0, 0, time.Local), false}, // Saturday
+		{time.Date(2026, 10, 17, 23, 0, 0, 0, time.Local), true},  // Saturday night
+		{time.Date(2026, 10, 18, 7, 0, 0, 0, time.Local), true},   // Sunday morning
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, time.Local), false},  // Monday morning
+	} {
+		e.now = func() time.Time { return tt.now }
+		e.replied = make(map[string]time.Time)
+		replied, err := e.Handle(context.Background(), msg)
+		if err != nil || replied != tt.want {
+			t.Errorf("Handle at %v = %v, %v, want %v", tt.now, replied, err, tt.want)
+		}
+	}
+	if len(c.bodies) == 0 || !strings.Contains(c.bodies[0], "Away, Bob") {
+		t.Errorf("sent %v, want the away reply", c.bodies)
+	}
+
+	e.replied = make(map[string]time.Time)
+	for _, from := range []string{"@news", "gh_123"} {
+		official := &wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: from, SenderUserName: from, Content: "news"}
+		if replied, err := e.Handle(context.Background(), official); err != nil || replied {
+			t.Errorf("Handle of %s = %v, %v, want no away reply to official accounts", from, replied, err)
+		}
+	}
+}
+
+func TestHandleSendFailure(t *testing.T) {
+	e, c := newTestEngine(t, testRules)
+	msg := &wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@a", SenderUserName: "@a", Content: "ping there"}
+	c.fail = true
+	if replied, err := e.Handle(context.Background(), msg); err == nil || replied {
+		t.Errorf("Handle = %v, %v, want an error", replied, err)
+	}
+	// The failed reply does not start the cooldown.
+	c.fail = false
+	if replied, err := e.Handle(context.Background(), msg); err != nil || !replied {
+		t.Errorf("Handle after the failure = %v, %v, want a reply", replied, err)
+	}
+}
+
+func TestHandleConcurrent(t *testing.T) {
+	e, c := newTestEngine(t, testRules)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := &wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@a", SenderUserName: "@a", Content: "ping there"}
+			if _, err := e.Handle(context.Background(), msg); err != nil {
+				t.Errorf("Handle: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(c.bodies) != 1 {
+		t.Errorf("sent %d replies, want 1", len(c.bodies))
+	}
+}
+
+func TestReload(t *testing.T) {
+	e, c := newTestEngine(t, testRules)
+	if err := ioutil.WriteFile(e.Path, []byte("rules:\n  - keywords: [hi]\n    reply: hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(e.Path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, time.Millisecond)
+	msg := &wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@b", SenderUserName: "@b", Content: "hi"}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if replied, _ := e.Handle(context.Background(), msg); replied {
+			if !strings.Contains(c.bodies[len(c.bodies)-1], `"Content":"hello"`) {
+				t.Errorf("sent %s, want hello", c.bodies[len(c.bodies)-1])
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("rules not reloaded")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, rules := range []string{
+		"rules:\n  - regex: \"(\"\n    reply: x\n",
+		"rules:\n  - keywords: [x]\n",
+		"away:\n  schedule:\n    - days: [someday]\n  reply: x\n",
+		"unknown: 1\n",
+	} {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%q) succeeded, want error", rules)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package autoreply
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/huangw5/webwx/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of a rules file. Example in YAML:
+//
+//	cooldown: 10m
+//	away:
+//	  schedule:
+//	    - days: [sat, sun]
+//	    - start: "22:00"
+//	      end: "08:00"
+//	  reply: "I am away and will get back to you later."
+//	rules:
+//	  - name: ping
+//	    from: [Alice]
+//	    regex: "^ping$"
+//	    reply: "pong, {{.NickName}}"
+//	  - name: team
+//	    groups: [Team]
+//	    keywords: [urgent]
+//	    reply: "On it."
+//	    cooldown: 1h
+type Config struct {
+	// Cooldown is the default Rule.Cooldown.
+	Cooldown Duration `yaml:"cooldown" json:"cooldown"`
+	Away     *Away    `yaml:"away" json:"away"`
+	Rules    []*Rule  `yaml:"rules" json:"rules"`
+}
+
+// Rule replies to the messages that match all of its criteria. Within a
+// list, any item matches.
+type Rule struct {
+	// Name identifies the rule in logs and cooldowns.
+	Name string `yaml:"name" json:"name"`
+	// From are the remark names, nicknames, aliases or user names of the
+	// senders.
+	From []string `yaml:"from" json:"from"`
+	// Groups are the nicknames or user names of the groups. Without it, the
+	// rule only matches direct messages. "*" matches any group.
+	Groups []string `yaml:"groups" json:"groups"`
+	// Types are the MsgTypes. Defaults to text.
+	Types []int `yaml:"types" json:"types"`
+	// Keywords are substrings of the text, case insensitive.
+	Keywords []string `yaml:"keywords" json:"keywords"`
+	// Regex is matched against the text. Its submatches are available to
+	// the reply as {{.Match}}.
+	Regex string `yaml:"regex" json:"regex"`
+	// Reply is a text/template executed with a Data.
+	Reply string `yaml:"reply" json:"reply"`
+	// Cooldown is the minimum time between two replies of this rule to the
+	// same chat.
+	Cooldown Duration `yaml:"cooldown" json:"cooldown"`
+	// OnlyAway makes the rule match only while away.
+	OnlyAway bool `yaml:"only_away" json:"only_away"`
+
+	regex *regexp.Regexp
+	reply *template.Template
+}
+
+// Away replies to direct messages not matched by any rule while away.
+type Away struct {
+	// Enabled makes it away regardless of Schedule.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Schedule are the times when it is away.
+	Schedule []*Window `yaml:"schedule" json:"schedule"`
+	// Reply is a text/template executed with a Data.
+	Reply string `yaml:"reply" json:"reply"`
+	// Cooldown defaults to Config.Cooldown.
+	Cooldown Duration `yaml:"cooldown" json:"cooldown"`
+
+	reply *template.Template
+}
+
+// Window is a time range on some days of the week, in local time.
+type Window struct {
+	// Days are like "mon" or "sunday". Defaults to every day.
+	Days []string `yaml:"days" json:"days"`
+	// Start and End are like "22:00". They default to the whole day. If End
+	// is before Start, the window ends on the next day.
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+
+	days       map[time.Weekday]bool
+	start, end time.Duration
+}
+
+// Duration is a time.Duration written like "10m".
+type Duration = config.Duration
+
+// Load reads the rules file at path. It is JSON if the name ends with .json
+// and YAML otherwise.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(b, c)
+	} else {
+		err = yaml.UnmarshalStrict(b, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error on parsing %s: %v", path, err)
+	}
+	if err := c.compile(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return c, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compile validates c and prepares its regexes, templates and windows.
+func (c *Config) compile() error {
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule name: %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Reply == "" {
+			return fmt.Errorf("rule %s has no reply", r.Name)
+		}
+		var err error
+		if r.reply, err = template.New(r.Name).Parse(r.Reply); err != nil {
+			return fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		if r.Regex != "" {
+			if r.regex, err = regexp.Compile(r.Regex); err != nil {
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+		if r.Cooldown == 0 {
+			r.Cooldown = c.Cooldown
+		}
+	}
+	if a := c.Away; a != nil {
+		if a.Reply == "" {
+			return fmt.Errorf("away has no reply")
+		}
+		var err error
+		if a.reply, err = template.New("away").Parse(a.Reply); err != nil {
+			return fmt.Errorf("away: %v", err)
+		}
+		if a.Cooldown == 0 {
+			a.Cooldown = c.Cooldown
+		}
+		for _, w := range a.Schedule {
+			if err := w.compile(); err != nil {
+				return fmt.Errorf("away: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *Window) compile() error {
+	w.days = make(map[time.Weekday]bool)
+	for _, d := range w.Days {
+		d = strings.ToLower(d)
+		if len(d) > 3 {
+			d = d[:3]
+		}
+		wd, ok := weekdays[d]
+		if !ok {
+			return fmt.Errorf("unknown day: %s", d)
+		}
+		w.days[wd] = true
+	}
+	var err error
+	if w.start, err = parseClock(w.Start, 0); err != nil {
+		return err
+	}
+	w.end, err = parseClock(w.End, 24*time.Hour)
+	return err
+}
+
+// parseClock parses a time of day like "22:00" into the time since
+// midnight.
+func parseClock(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains returns whether w contains t.
+func (w *Window) contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := func(d time.Weekday) bool { return len(w.days) == 0 || w.days[d] }
+	if w.start <= w.end {
+		return day(t.Weekday()) && clock >= w.start && clock < w.end
+	}
+	// Overnight: the part after start on a listed day, or the part before
+	// end on the day after.
+	if clock >= w.start {
+		return day(t.Weekday())
+	}
+	return clock < w.end && day((t.Weekday()+6)%7)
+}
+
+// away returns whether a is away at t.
+func (a *Away) away(t time.Time) bool {
+	if a.Enabled {
+		return true
+	}
+	for _, w := range a.Schedule {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
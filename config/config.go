@@ -0,0 +1,398 @@
+// Package config loads the configuration file of the webwx command.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/huangw5/webwx/email"
+	"gopkg.in/yaml.v2"
+)
+
+// Defaults of the optional settings.
+const (
+	DefaultAppID           = "wx782c26e4c19acffb"
+	DefaultSMTP            = "smtp.gmail.com:587"
+	DefaultEmailInterval   = time.Minute
+	DefaultForwardInterval = time.Minute
+	DefaultWebhookInterval = 5 * time.Second
+	DefaultListen          = "localhost:8080"
+)
+
+// Config is the content of a config file. Example:
+//
+//	session: session.json
+//	qr: terminal
+//	email:
+//	  from: me@gmail.com
+//	  password_file: /run/secrets/smtp
+//	  to: [me@gmail.com, "${BACKUP_EMAIL}"]
+//	  interval: 5m
+//	forward:
+//	  - to: Alice
+//	  - to: Family
+//	    interval: 10m
+//	webhooks:
+//	  - url: https://example.com/hook
+//	    secret_file: /run/secrets/hook
+//	    headers:
+//	      Authorization: "Bearer ${HOOK_TOKEN}"
+//
+// After parsing, ${VAR} in string settings is replaced with the environment
+// variable VAR, and ${VAR:-default} with default if VAR is not set. The
+// values are used verbatim, so they need no YAML quoting, but ${VAR} must be
+// quoted where YAML requires it, e.g. in [lists]. Comments are ignored, and
+// settings like intervals do not support it.
+type Config struct {
+	AppID      string   `yaml:"appid"`
+	Session    string   `yaml:"session"`
+	QR         string   `yaml:"qr"`
+	Record     string   `yaml:"record"`
+	Retries    int      `yaml:"retries"`
+	RetryDelay Duration `yaml:"retry_delay"`
+	AutoReply  string   `yaml:"autoreply"`
+	Archive    string   `yaml:"archive"`
+	MediaDir   string   `yaml:"media_dir"`
+	API        API      `yaml:"api"`
+	// Email is nil if new messages are not emailed.
+	Email    *Email     `yaml:"email"`
+	Forward  []*Forward `yaml:"forward"`
+	Webhooks []*Webhook `yaml:"webhooks"`
+}
+
+// API configures the serve command.
+type API struct {
+	Listen    string `yaml:"listen"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// Email sends new messages to To.
+type Email struct {
+	From         string   `yaml:"from"`
+	Password     string   `yaml:"password"`
+	PasswordFile string   `yaml:"password_file"`
+	SMTP         string   `yaml:"smtp"`
+	To           []string `yaml:"to"`
+	// Detail is whether the emails include the messages. Defaults to true.
+	Detail   *bool    `yaml:"detail"`
+	Interval Duration `yaml:"interval"`
+	// TLS is auto, implicit, starttls, opportunistic or none. Auto uses
+	// implicit TLS on port 465 and STARTTLS if offered otherwise.
+	TLS string `yaml:"tls"`
+	// Auth is plain, login, cram-md5, xoauth2 or none. Defaults to plain.
+	// For xoauth2, the password is the access token.
+	Auth string `yaml:"auth"`
+	// Username defaults to From.
+	Username string `yaml:"username"`
+	// CAFile has the PEM certificates to verify the SMTP server with, e.g.
+	// of a private CA.
+	CAFile string `yaml:"ca_file"`
+	// IdleTimeout is how long the SMTP connection is kept open for the
+	// next email. Zero closes it after each email.
+	IdleTimeout Duration `yaml:"idle_timeout"`
+}
+
+// Forward forwards new messages to the contact To, which is a remark name,
+// nickname or alias.
+type Forward struct {
+	To       string   `yaml:"to"`
+	Interval Duration `yaml:"interval"`
+}
+
+// Webhook posts new messages to URL.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Template is the file with the text/template of the body.
+	Template    string            `yaml:"template"`
+	Secret      string            `yaml:"secret"`
+	SecretFile  string            `yaml:"secret_file"`
+	Headers     map[string]string `yaml:"headers"`
+	MaxAttempts int               `yaml:"max_attempts"`
+	Interval    Duration          `yaml:"interval"`
+}
+
+// Duration is a time.Duration written like "10m". The rules files of
+// autoreply use it too.
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the config used without a config file.
+func Default() *Config {
+	return &Config{
+		AppID:      DefaultAppID,
+		QR:         "file",
+		Retries:    3,
+		RetryDelay: Duration(time.Second),
+		API:        API{Listen: DefaultListen},
+	}
+}
+
+var envRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in every string of c. It
+// fails if a VAR without a default is not set.
+func expandEnv(c *Config) error {
+	missing := make(map[string]bool)
+	expandStrings(reflect.ValueOf(c), missing)
+	if len(missing) > 0 {
+		var names []string
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("environment variables not set: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// expandStrings expands the strings in v, and in the fields, elements and
+// map values of v, recording the unset variables in missing.
+func expandStrings(v reflect.Value, missing map[string]bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandStrings(v.Elem(), missing)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				expandStrings(v.Field(i), missing)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandStrings(v.Index(i), missing)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, k := range v.MapKeys() {
+			s := expandString(v.MapIndex(k).String(), missing)
+			v.SetMapIndex(k, reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		v.SetString(expandString(v.String(), missing))
+	}
+}
+
+func expandString(s string, missing map[string]bool) string {
+	return envRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envRe.FindStringSubmatch(m)
+		if v, ok := os.LookupEnv(sub[1]); ok {
+			return v
+		}
+		if strings.Contains(m, ":-") {
+			return sub[2]
+		}
+		missing[sub[1]] = true
+		return ""
+	})
+}
+
+// Load reads the YAML config file at path on top of Default. Call Validate
+// once any overrides are applied.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Default()
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("error on parsing %s: %v", path, err)
+	}
+	if err := expandEnv(c); err != nil {
+		return nil, fmt.Errorf("error on reading %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// EmailConfig returns c.Email, creating it if needed.
+func (c *Config) EmailConfig() *Email {
+	if c.Email == nil {
+		c.Email = &Email{}
+	}
+	return c.Email
+}
+
+// SetPassword sets the password, replacing the password_file of the config
+// file.
+func (e *Email) SetPassword(password string) {
+	e.Password, e.PasswordFile = password, ""
+}
+
+// SetPasswordFile sets the password file, replacing the password of the
+// config file.
+func (e *Email) SetPasswordFile(file string) {
+	e.Password, e.PasswordFile = "", file
+}
+
+// SetSecret sets the secret, replacing the secret_file of the config file.
+func (w *Webhook) SetSecret(secret string) {
+	w.Secret, w.SecretFile = secret, ""
+}
+
+// ShowDetail returns whether the emails include the messages.
+func (e *Email) ShowDetail() bool {
+	return e.Detail == nil || *e.Detail
+}
+
+// readSecret sets *value to the content of file, if set, without the
+// trailing newline.
+func readSecret(name string, value *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%s and %s_file are both set", name, name)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s_file: %v", name, err)
+	}
+	*value = strings.TrimRight(string(b), "\r\n")
+	return nil
+}
+
+// Validate checks c, fills in the defaults and reads the secrets of the
+// *_file settings. The error lists every problem found.
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	if c.QR != "file" && c.QR != "terminal" {
+		fail("qr: must be file or terminal, not %q", c.QR)
+	}
+	if c.Retries < 1 {
+		fail("retries: must be at least 1, not %d", c.Retries)
+	}
+	if c.RetryDelay < 0 {
+		fail("retry_delay: must not be negative")
+	}
+	if c.MediaDir != "" && c.Archive == "" {
+		fail("media_dir: needs archive")
+	}
+	if err := readSecret("api.token", &c.API.Token, c.API.TokenFile); err != nil {
+		fail("%v", err)
+	}
+	if e := c.Email; e != nil {
+		if e.Username == "" {
+			e.Username = e.From
+		}
+		if e.SMTP == "" {
+			e.SMTP = DefaultSMTP
+		}
+		if e.Interval == 0 {
+			e.Interval = Duration(DefaultEmailInterval)
+		}
+		if _, err := mail.ParseAddress(e.From); err != nil {
+			fail("email.from: invalid address %q: %v", e.From, err)
+		}
+		if len(e.To) == 0 {
+			fail("email.to: needs at least one recipient")
+		}
+		for i, to := range e.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				fail("email.to[%d]: invalid address %q: %v", i, to, err)
+			}
+		}
+		if _, _, err := net.SplitHostPort(e.SMTP); err != nil {
+			fail("email.smtp: must be host:port: %v", err)
+		}
+		if e.TLS == "auto" {
+			e.TLS = ""
+		}
+		if !email.TLSMode(e.TLS).Valid() {
+			fail("email.tls: must be auto, implicit, starttls, opportunistic or none, not %q", e.TLS)
+		}
+		if !email.AuthMechanism(e.Auth).Valid() {
+			fail("email.auth: must be plain, login, cram-md5, xoauth2 or none, not %q", e.Auth)
+		}
+		if err := readSecret("email.password", &e.Password, e.PasswordFile); err != nil {
+			fail("%v", err)
+		} else if e.Password == "" && email.AuthMechanism(e.Auth) != email.AuthNone {
+			fail("email.password: needs password or password_file, or auth: none")
+		}
+		if e.CAFile != "" {
+			if _, err := email.LoadCertPool(e.CAFile); err != nil {
+				fail("email.ca_file: %v", err)
+			}
+		}
+		if e.IdleTimeout < 0 {
+			fail("email.idle_timeout: must not be negative")
+		}
+		if e.Interval < 0 {
+			fail("email.interval: must not be negative")
+		}
+	}
+	for i, f := range c.Forward {
+		if f.Interval == 0 {
+			f.Interval = Duration(DefaultForwardInterval)
+		}
+		if f.To == "" {
+			fail("forward[%d].to: must not be empty", i)
+		}
+		if f.Interval < 0 {
+			fail("forward[%d].interval: must not be negative", i)
+		}
+	}
+	for i, h := range c.Webhooks {
+		if h.Interval == 0 {
+			h.Interval = Duration(DefaultWebhookInterval)
+		}
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhooks[%d].url: must be an http or https URL, not %q", i, h.URL)
+		}
+		if err := readSecret(fmt.Sprintf("webhooks[%d].secret", i), &h.Secret, h.SecretFile); err != nil {
+			fail("%v", err)
+		}
+		if h.MaxAttempts < 0 {
+			fail("webhooks[%d].max_attempts: must not be negative", i)
+		}
+		if h.Interval < 0 {
+			fail("webhooks[%d].interval: must not be negative", i)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("WEBWX_TEST_TO", "b@example.com")
+	defer os.Unsetenv("WEBWX_TEST_TO")
+	// Values are used verbatim, even if they look like YAML.
+	os.Setenv("WEBWX_TEST_TOKEN", "a: b # c\nd")
+	defer os.Unsetenv("WEBWX_TEST_TOKEN")
+	secret := write(t, dir, "secret", "s3cret\n")
+	path := write(t, dir, "config.yaml", `
+# Comments may mention ${WEBWX_TEST_UNSET}.
+session: session.json
+email:
+  from: me@example.com
+  password_file: `+secret+`
+  to: [a@example.com, "${WEBWX_TEST_TO}"]
+  detail: false
+forward:
+  - to: Alice
+  - to: "${WEBWX_TEST_FORWARD:-Bob}"
+    interval: 10m
+webhooks:
+  - url: https://example.com/hook
+    secret_file: `+secret+`
+    headers:
+      X-Token: abc
+      X-Other: ${WEBWX_TEST_TOKEN}
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if c.AppID != DefaultAppID || c.QR != "file" || c.Session != "session.json" {
+		t.Errorf("got %+v, want the defaults and the session", c)
+	}
+	e := c.Email
+	if e.Password != "s3cret" || e.SMTP != DefaultSMTP || e.ShowDetail() || time.Duration(e.Interval) != DefaultEmailInterval {
+		t.Errorf("got email %+v", e)
+	}
+	if got := strings.Join(e.To, ","); got != "a@example.com,b@example.com" {
+		t.Errorf("email.to = %s", got)
+	}
+	if len(c.Forward) != 2 || c.Forward[1].To != "Bob" || time.Duration(c.Forward[0].Interval) != DefaultForwardInterval || time.Duration(c.Forward[1].Interval) != 10*time.Minute {
+		t.Errorf("got forward %+v %+v", c.Forward[0], c.Forward[1])
+	}
+	if h := c.Webhooks[0]; h.Secret != "s3cret" || h.Headers["X-Token"] != "abc" || h.Headers["X-Other"] != "a: b # c\nd" || time.Duration(h.Interval) != DefaultWebhookInterval {
+		t.Errorf("got webhook %+v", h)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range []struct {
+		content string
+		want    string
+	}{
+		{"email:\n  to: [\"${WEBWX_TEST_UNSET}\"]\n", "environment variables not set: WEBWX_TEST_UNSET"},
+		{"emails:\n  to: [a@example.com]\n", "field emails not found"},
+		{"retry_delay: soon\n", "invalid duration"},
+	} {
+		_, err := Load(write(t, dir, "config.yaml", tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Load(%q) returned %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}
+
+func TestSetSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+email:
+  from: me@example.com
+  to: [you@example.com]
+  password_file: /nonexistent
+webhooks:
+  - url: https://example.com/hook
+    secret_file: /nonexistent
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	// The flags replace the files of the config file.
+	c.Email.SetPassword("p")
+	c.Webhooks[0].SetSecret("s")
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if c.Email.Password != "p" || c.Webhooks[0].Secret != "s" {
+		t.Errorf("password, secret = %q, %q, want p, s", c.Email.Password, c.Webhooks[0].Secret)
+	}
+
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(secret, []byte("q\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Email.SetPasswordFile(secret)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if c.Email.Password != "q" {
+		t.Errorf("password = %q, want q", c.Email.Password)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.QR = "png"
+	c.MediaDir = "media"
+	c.Email = &Email{From: "me", To: []string{"a@example.com", "b"}, Password: "p", PasswordFile: "/p", TLS: "ssl", Auth: "ntlm", IdleTimeout: -1}
+	c.Forward = []*Forward{{}}
+	c.Webhooks = []*Webhook{{URL: "example.com/hook"}}
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("Validate succeeded, want error")
+	}
+	for _, want := range []string{
+		"qr: must be file or terminal",
+		"media_dir: needs archive",
+		"email.from: invalid address",
+		"email.to[1]: invalid address",
+		"email.password and email.password_file are both set",
+		`email.tls: must be auto, implicit, starttls, opportunistic or none, not "ssl"`,
+		`email.auth: must be plain, login, cram-md5, xoauth2 or none, not "ntlm"`,
+		"email.idle_timeout: must not be negative",
+		"forward[0].to: must not be empty",
+		"webhooks[0].url: must be an http or https URL",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate returned %v, want %q", err, want)
+		}
+	}
+}
@@ -1,14 +1,23 @@
 package email
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
-	"net"
-	"net/smtp"
+	"html"
+	"net/http"
 	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
 )
 
 // Email is for sending emails.
 // Example:
+//
 //	m := &email.Email{
 //		From:     "xxx@gmail.com",
 //		Pass:     "xxx",
@@ -21,15 +30,151 @@ type Email struct {
 	From     string
 	Pass     string
 	SMTPAddr string
+	// Sender delivers the emails. Defaults to SMTP to SMTPAddr,
+	// authenticated with From and Pass.
+	Sender Sender
+	// To and Detail are used by Notify. Without Detail, the emails only say
+	// that there are new messages.
+	To     []string
+	Detail bool
+	// Image, if set, returns the image of an image or emoticon message, so
+	// that Notify can show it inline. It returns nil for other messages.
+	Image func(ctx context.Context, msg *wechat.AddMsg) ([]byte, error)
 }
 
-// Send sends a message.
+// Send sends a plain text message.
 func (m *Email) Send(to []string, subject string, body string) error {
-	host, _, err := net.SplitHostPort(m.SMTPAddr)
+	return m.SendMessage(&Message{From: m.From, To: to, Subject: subject, Text: body})
+}
+
+// SendMessage sends msg to msg.To.
+func (m *Email) SendMessage(msg *Message) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return fmt.Errorf("error on encoding email: %v", err)
+	}
+	return m.sender().Send(m.From, msg.To, b)
+}
+
+// sender returns m.Sender, defaulting to SMTP to m.SMTPAddr with PLAIN auth.
+func (m *Email) sender() Sender {
+	if m.Sender != nil {
+		return m.Sender
+	}
+	return &SMTP{Addr: m.SMTPAddr, Username: m.From, Password: m.Pass}
+}
+
+// Notify implements notify.Notifier. With Detail, it sends one email per
+// conversation, threaded with the earlier emails about it, and returns the
+// messages of the failed ones in a notify.PartialError. Otherwise it sends a
+// single email without the content.
+func (m *Email) Notify(ctx context.Context, msgs []*wechat.AddMsg) error {
+	if !m.Detail {
+		body := fmt.Sprintf("%d new messages.", len(msgs))
+		return m.Send(m.To, "New WeChat messages", body)
+	}
+	var failed []*wechat.AddMsg
+	var errs []string
+	for _, c := range conversations(msgs) {
+		if err := m.SendMessage(m.compose(ctx, c)); err != nil {
+			failed = append(failed, c.msgs...)
+			errs = append(errs, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return &notify.PartialError{
+			Failed: failed,
+			Err:    fmt.Errorf("error on sending emails: %s", strings.Join(errs, "; ")),
+		}
+	}
+	return nil
+}
+
+// conversation is the messages of a chat.
+type conversation struct {
+	name string
+	msgs []*wechat.AddMsg
+}
+
+// conversations groups msgs by chat, in the order of their first messages.
+func conversations(msgs []*wechat.AddMsg) []*conversation {
+	var res []*conversation
+	byName := make(map[string]*conversation)
+	for _, msg := range msgs {
+		// User names change on every login, so use the names.
+		name := msg.GroupNickName
+		if name == "" {
+			name = msg.NickName
+		}
+		c, ok := byName[name]
+		if !ok {
+			c = &conversation{name: name}
+			byName[name] = c
+			res = append(res, c)
+		}
+		c.msgs = append(c.msgs, msg)
+	}
+	return res
+}
+
+// threadID returns the message ID that all emails about the conversation
+// name refer to, so that they thread together.
+func (m *Email) threadID(name string) string {
+	h := sha1.Sum([]byte(strings.Join(m.To, ",") + "\x00" + name))
+	return fmt.Sprintf("<wechat.%s@%s>", hex.EncodeToString(h[:10]), domain(m.From))
+}
+
+// compose returns the email about c.
+func (m *Email) compose(ctx context.Context, c *conversation) *Message {
+	thread := m.threadID(c.name)
+	msg := &Message{
+		From:       m.From,
+		To:         m.To,
+		Subject:    "WeChat: " + c.name,
+		InReplyTo:  thread,
+		References: []string{thread},
+		Text:       notify.Format(c.msgs),
+	}
+	var h strings.Builder
+	fmt.Fprintf(&h, "<html><body>\n<h3>%s</h3>\n", html.EscapeString(c.name))
+	for _, am := range c.msgs {
+		t := time.Unix(am.CreateTime, 0).Format("15:04")
+		fmt.Fprintf(&h, "<p><small>%s</small> <b>%s</b>: ", t, html.EscapeString(am.NickName))
+		if in := m.inline(ctx, am); in != nil {
+			msg.Inline = append(msg.Inline, in)
+			fmt.Fprintf(&h, "<br><img src=\"cid:%s\" alt=\"%s\" style=\"max-width:100%%\">", in.ContentID, html.EscapeString(in.Name))
+		} else {
+			h.WriteString(strings.Replace(html.EscapeString(notify.Describe(am)), "\n", "<br>", -1))
+		}
+		h.WriteString("</p>\n")
+	}
+	h.WriteString("</body></html>\n")
+	msg.HTML = h.String()
+	return msg
+}
+
+// inline returns the image of msg to show inline, if any.
+func (m *Email) inline(ctx context.Context, msg *wechat.AddMsg) *Inline {
+	if m.Image == nil || (msg.MsgType != wechat.MsgTypeImage && msg.MsgType != wechat.MsgTypeEmoticon) {
+		return nil
+	}
+	b, err := m.Image(ctx, msg)
 	if err != nil {
-		return err
+		glog.Warningf("Failed to get image of %s: %v", msg.MsgID, err)
+		return nil
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	contentType := http.DetectContentType(b)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil
+	}
+	ext := strings.TrimPrefix(contentType, "image/")
+	return &Inline{
+		ContentID:   fmt.Sprintf("%s@%s", msg.MsgID, domain(m.From)),
+		Name:        fmt.Sprintf("%s.%s", msg.MsgID, ext),
+		ContentType: contentType,
+		Data:        b,
 	}
-	auth := smtp.PlainAuth("", m.From, m.Pass, host)
-	msg := []byte(fmt.Sprintf("To: %s\r\n"+"Subject: %s\r\n"+"\r\n"+"%s\r\n", strings.Join(to, ","), subject, body))
-	return smtp.SendMail(m.SMTPAddr, auth, m.From, to, msg)
 }
@@ -0,0 +1,171 @@
+package email
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+// png is the start of a PNG image, enough for http.DetectContentType.
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// part is a decoded leaf part of a MIME message.
+type part struct {
+	header map[string][]string
+	body   string
+}
+
+// leaves returns the leaf parts of the body r with the given content type.
+func leaves(t *testing.T, contentType string, r io.Reader) []*part {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("ParseMediaType(%q) failed: %v", contentType, err)
+	}
+	if !strings.HasPrefix(mt, "multipart/") {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", mt, err)
+		}
+		return []*part{{header: map[string][]string{"Content-Type": {contentType}}, body: string(b)}}
+	}
+	var res []*part
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatalf("NextPart of %s failed: %v", mt, err)
+		}
+		var body io.Reader = p
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			body = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		ct := p.Header.Get("Content-Type")
+		if strings.HasPrefix(ct, "multipart/") {
+			res = append(res, leaves(t, ct, body)...)
+			continue
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", ct, err)
+		}
+		res = append(res, &part{header: p.Header, body: string(b)})
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := &Message{
+		From:       "Me <me@example.com>",
+		To:         []string{"a@example.com", "张三 <b@example.com>"},
+		Subject:    "WeChat: 张三",
+		InReplyTo:  "<thread@example.com>",
+		References: []string{"<thread@example.com>"},
+		Text:       "张三: 你好",
+		HTML:       `<p>你好<img src="cid:1@example.com"></p>`,
+		Inline:     []*Inline{{ContentID: "1@example.com", Name: "1.png", ContentType: "image/png", Data: png}},
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("line too long: %d", len(line))
+		}
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	dec := new(mime.WordDecoder)
+	if got, _ := dec.DecodeHeader(msg.Header.Get("Subject")); got != m.Subject {
+		t.Errorf("Subject = %q, want %q", got, m.Subject)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[1].Name != "张三" {
+		t.Errorf("To = %v, %v, want 2 addresses with the name", to, err)
+	}
+	for _, h := range []string{"Date", "Message-ID"} {
+		if msg.Header.Get(h) == "" {
+			t.Errorf("no %s header", h)
+		}
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<thread@example.com>" {
+		t.Errorf("In-Reply-To = %q", got)
+	}
+	if got := msg.Header.Get("References"); got != "<thread@example.com>" {
+		t.Errorf("References = %q", got)
+	}
+	ps := leaves(t, msg.Header.Get("Content-Type"), msg.Body)
+	if len(ps) != 3 {
+		t.Fatalf("got %d parts, want text, HTML and the image", len(ps))
+	}
+	if ps[0].body != m.Text || ps[1].body != m.HTML || ps[2].body != string(png) {
+		t.Errorf("got parts %q, %q, %q", ps[0].body, ps[1].body, ps[2].body)
+	}
+	if got := ps[2].header["Content-Id"]; len(got) != 1 || got[0] != "<1@example.com>" {
+		t.Errorf("Content-ID = %q", got)
+	}
+}
+
+func TestMessageBytesPlain(t *testing.T) {
+	b, err := (&Message{From: "me@example.com", To: []string{"a@example.com"}, Subject: "Hi", Text: "你好"}).Bytes()
+	if err != nil {
+		t.Fatalf("Bytes failed: %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Hi" {
+		t.Errorf("Subject = %q, want it unencoded", got)
+	}
+	ps := leaves(t, msg.Header.Get("Content-Type"), msg.Body)
+	if len(ps) != 1 || !strings.Contains(ps[0].body, "=E4=BD=A0") {
+		t.Errorf("got %+v, want the quoted-printable text", ps)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	m := &Email{
+		From: "me@example.com",
+		To:   []string{"a@example.com"},
+		Image: func(ctx context.Context, msg *wechat.AddMsg) ([]byte, error) {
+			return png, nil
+		},
+	}
+	msgs := []*wechat.AddMsg{
+		{MsgID: "1", MsgType: wechat.MsgTypeText, NickName: "Alice", Content: "<hi>"},
+		{MsgID: "2", MsgType: wechat.MsgTypeText, NickName: "Bob", GroupNickName: "Team", Content: "@me hi", MentionedMe: true},
+		{MsgID: "3", MsgType: wechat.MsgTypeImage, NickName: "Alice"},
+	}
+	cs := conversations(msgs)
+	if len(cs) != 2 || cs[0].name != "Alice" || len(cs[0].msgs) != 2 || cs[1].name != "Team" {
+		t.Fatalf("got conversations %+v, want Alice and Team", cs)
+	}
+	alice := m.compose(context.Background(), cs[0])
+	if alice.Subject != "WeChat: Alice" {
+		t.Errorf("Subject = %q", alice.Subject)
+	}
+	if !strings.Contains(alice.HTML, "&lt;hi&gt;") || !strings.Contains(alice.HTML, `src="cid:3@example.com"`) {
+		t.Errorf("HTML = %q, want the escaped text and the image", alice.HTML)
+	}
+	if len(alice.Inline) != 1 || alice.Inline[0].Name != "3.png" {
+		t.Errorf("Inline = %+v, want 3.png", alice.Inline)
+	}
+	again := m.compose(context.Background(), &conversation{name: "Alice", msgs: msgs[:1]})
+	team := m.compose(context.Background(), cs[1])
+	if alice.InReplyTo == "" || again.InReplyTo != alice.InReplyTo || team.InReplyTo == alice.InReplyTo {
+		t.Errorf("threads: %q, %q, %q, want the same for Alice only", alice.InReplyTo, again.InReplyTo, team.InReplyTo)
+	}
+}
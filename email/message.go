@@ -0,0 +1,198 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email. Bytes encodes it as MIME.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Date    time.Time
+	// MessageID, InReplyTo and References are message IDs like
+	// "<id@example.com>". MessageID is generated if empty.
+	MessageID  string
+	InReplyTo  string
+	References []string
+	// Text is the plain text body. HTML, if set, is the alternative shown
+	// by clients that can.
+	Text string
+	HTML string
+	// Inline are the images referred to by HTML as "cid:<ContentID>".
+	Inline []*Inline
+}
+
+// Inline is an image shown in the HTML body of a Message.
+type Inline struct {
+	ContentID   string
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// domain returns the domain of the address addr, for message IDs.
+func domain(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	if i := strings.LastIndex(addr, "@"); i >= 0 && i < len(addr)-1 {
+		return addr[i+1:]
+	}
+	return "localhost"
+}
+
+// newMessageID returns a new unique message ID in domain.
+func newMessageID(domain string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// encodeAddress returns addr with its display name, if any, encoded as
+// UTF-8.
+func encodeAddress(addr string) string {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return addr
+	}
+	return a.String()
+}
+
+// Bytes returns m as a MIME message. Headers are UTF-8 encoded and bodies
+// quoted-printable or base64 encoded, so they stay intact in any client.
+func (m *Message) Bytes() ([]byte, error) {
+	if m.MessageID == "" {
+		m.MessageID = newMessageID(domain(m.From))
+	}
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var to []string
+	for _, addr := range m.To {
+		to = append(to, encodeAddress(addr))
+	}
+	var b bytes.Buffer
+	header := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	header("From", encodeAddress(m.From))
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("Message-ID", m.MessageID)
+	header("In-Reply-To", m.InReplyTo)
+	header("References", strings.Join(m.References, " "))
+	header("MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		if err := writeQP(&b, m.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	outer := multipart.NewWriter(&b)
+	alt := outer
+	if len(m.Inline) > 0 {
+		header("Content-Type", mime.FormatMediaType("multipart/related", map[string]string{"boundary": outer.Boundary(), "type": "multipart/alternative"}))
+		b.WriteString("\r\n")
+		var inner bytes.Buffer
+		alt = multipart.NewWriter(&inner)
+		if err := m.writeAlternative(alt); err != nil {
+			return nil, err
+		}
+		w, err := outer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(inner.Bytes()); err != nil {
+			return nil, err
+		}
+		for _, in := range m.Inline {
+			if err := writeInline(outer, in); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		header("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": outer.Boundary()}))
+		b.WriteString("\r\n")
+		if err := m.writeAlternative(outer); err != nil {
+			return nil, err
+		}
+	}
+	if err := outer.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeAlternative writes the text and HTML parts to w and closes it.
+func (m *Message) writeAlternative(w *multipart.Writer) error {
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeQP(pw, part.body); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func writeQP(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, s); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeInline writes in as a base64 encoded part of w.
+func writeInline(w *multipart.Writer, in *Inline) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {in.ContentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-ID":                {"<" + in.ContentID + ">"},
+		"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": in.Name})},
+	})
+	if err != nil {
+		return err
+	}
+	enc := base64.StdEncoding.EncodeToString(in.Data)
+	for len(enc) > 76 {
+		if _, err := io.WriteString(pw, enc[:76]+"\r\n"); err != nil {
+			return err
+		}
+		enc = enc[76:]
+	}
+	_, err = io.WriteString(pw, enc+"\r\n")
+	return err
+}
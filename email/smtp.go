@@ -0,0 +1,311 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender delivers encoded emails. SMTP is the real one, and tests can swap
+// in a fake.
+type Sender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// TLSMode is how SMTP secures the connection.
+type TLSMode string
+
+// The TLS modes.
+const (
+	// TLSAuto uses TLSImplicit on port 465 and TLSOpportunistic otherwise.
+	TLSAuto TLSMode = ""
+	// TLSImplicit connects with TLS from the start, as on port 465.
+	TLSImplicit TLSMode = "implicit"
+	// TLSStartTLS upgrades the connection with STARTTLS and fails if the
+	// server does not offer it.
+	TLSStartTLS TLSMode = "starttls"
+	// TLSOpportunistic upgrades with STARTTLS if the server offers it.
+	TLSOpportunistic TLSMode = "opportunistic"
+	// TLSNone never encrypts the connection.
+	TLSNone TLSMode = "none"
+)
+
+// Valid returns whether m is one of the TLS modes.
+func (m TLSMode) Valid() bool {
+	switch m {
+	case TLSAuto, TLSImplicit, TLSStartTLS, TLSOpportunistic, TLSNone:
+		return true
+	}
+	return false
+}
+
+// AuthMechanism is how SMTP authenticates.
+type AuthMechanism string
+
+// The auth mechanisms.
+const (
+	// AuthPlain is PLAIN, the default.
+	AuthPlain AuthMechanism = "plain"
+	// AuthLogin is LOGIN, which some corporate relays need.
+	AuthLogin AuthMechanism = "login"
+	// AuthCRAMMD5 is CRAM-MD5, which does not send the password.
+	AuthCRAMMD5 AuthMechanism = "cram-md5"
+	// AuthXOAUTH2 is XOAUTH2. The password is the OAuth 2 access token.
+	AuthXOAUTH2 AuthMechanism = "xoauth2"
+	// AuthNone does not authenticate, for relays that trust the network.
+	AuthNone AuthMechanism = "none"
+)
+
+// Valid returns whether a is one of the auth mechanisms or empty.
+func (a AuthMechanism) Valid() bool {
+	switch a {
+	case "", AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAUTH2, AuthNone:
+		return true
+	}
+	return false
+}
+
+// SMTP is a Sender that delivers to an SMTP server.
+type SMTP struct {
+	// Addr is the host:port of the server.
+	Addr string
+	TLS  TLSMode
+	// Auth defaults to AuthPlain.
+	Auth     AuthMechanism
+	Username string
+	Password string
+	// RootCAs verify the certificate of the server. Nil uses the system
+	// pool. See LoadCertPool.
+	RootCAs *x509.CertPool
+	// Timeout limits connecting. Defaults to 30s.
+	Timeout time.Duration
+	// IdleTimeout is how long the connection is kept open for the next
+	// email. Zero closes it after each email.
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+// LoadCertPool returns the pool of the PEM certificates in the file at path,
+// e.g. a private CA.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// Send implements Sender. It reuses the open connection if there is one.
+func (s *SMTP) Send(from string, to []string, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil && (s.IdleTimeout == 0 || time.Since(s.lastUsed) > s.IdleTimeout || s.client.Reset() != nil) {
+		s.client.Close()
+		s.client = nil
+	}
+	if s.client == nil {
+		c, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.client = c
+	}
+	err := s.send(from, to, msg)
+	if err != nil || s.IdleTimeout == 0 {
+		s.closeLocked()
+		return err
+	}
+	s.lastUsed = time.Now()
+	return nil
+}
+
+// Close closes the open connection, if any.
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
+
+func (s *SMTP) closeLocked() error {
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	if err != nil {
+		s.client.Close()
+	}
+	s.client = nil
+	return err
+}
+
+func (s *SMTP) send(from string, to []string, msg []byte) error {
+	c := s.client
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("error on MAIL: %v", err)
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("error on RCPT %s: %v", addr, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error on DATA: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error writing email: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error on sending email: %v", err)
+	}
+	return nil
+}
+
+// dial connects, secures the connection and authenticates.
+func (s *SMTP) dial() (*smtp.Client, error) {
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	mode := s.TLS
+	if mode == TLSAuto {
+		mode = TLSOpportunistic
+		if port == "465" {
+			mode = TLSImplicit
+		}
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	tlsConfig := &tls.Config{ServerName: host, RootCAs: s.RootCAs}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if mode == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error on connecting to %s: %v", s.Addr, err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error on connecting to %s: %v", s.Addr, err)
+	}
+	if err := s.hello(c, mode, tlsConfig); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello upgrades c to TLS according to mode and authenticates.
+func (s *SMTP) hello(c *smtp.Client, mode TLSMode, tlsConfig *tls.Config) error {
+	if mode == TLSStartTLS || mode == TLSOpportunistic {
+		ok, _ := c.Extension("STARTTLS")
+		switch {
+		case ok:
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("error on STARTTLS: %v", err)
+			}
+		case mode == TLSStartTLS:
+			return errors.New("server does not support STARTTLS")
+		}
+	}
+	auth, err := s.auth(tlsConfig.ServerName)
+	if err != nil || auth == nil {
+		return err
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("server does not support AUTH")
+	}
+	if err := c.Auth(auth); err != nil {
+		return fmt.Errorf("error on AUTH: %v", err)
+	}
+	return nil
+}
+
+// auth returns the smtp.Auth of s.Auth, or nil for AuthNone.
+func (s *SMTP) auth(host string) (smtp.Auth, error) {
+	switch s.Auth {
+	case "", AuthPlain:
+		return smtp.PlainAuth("", s.Username, s.Password, host), nil
+	case AuthLogin:
+		return &loginAuth{username: s.Username, password: s.Password}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+	case AuthXOAUTH2:
+		return &xoauth2Auth{username: s.Username, token: s.Password}, nil
+	case AuthNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown auth mechanism: %s", s.Auth)
+}
+
+// secure returns whether credentials may be sent in the clear to server,
+// which net/smtp only allows over TLS or to localhost.
+func secure(server *smtp.ServerInfo) bool {
+	return server.TLS || server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+}
+
+// loginAuth implements the LOGIN mechanism.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !secure(server) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism.
+type xoauth2Auth struct {
+	username, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !secure(server) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sent the error as JSON. An empty response gets the
+		// final error code.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
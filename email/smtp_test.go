@@ -0,0 +1,283 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
+)
+
+// fakeSMTP is an SMTP server that accepts everything.
+type fakeSMTP struct {
+	ln net.Listener
+	// auth is the AUTH extension, if any.
+	auth string
+
+	mu    sync.Mutex
+	conns int
+	users []string
+	mails []string
+}
+
+func newFakeSMTP(t *testing.T, config *tls.Config, auth string) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+	s := &fakeSMTP{ln: ln, auth: auth}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) Addr() string { return s.ln.Addr().String() }
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 fake ESMTP")
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO":
+			if s.auth != "" {
+				c.PrintfLine("250-fake")
+				c.PrintfLine("250 AUTH %s", s.auth)
+			} else {
+				c.PrintfLine("250 fake")
+			}
+		case "AUTH":
+			args := strings.Fields(line)[1:]
+			var user string
+			switch args[0] {
+			case "LOGIN":
+				c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				u, _ := c.ReadLine()
+				c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				p, _ := c.ReadLine()
+				user = decode(u) + ":" + decode(p)
+			case "PLAIN", "XOAUTH2":
+				user = strings.Replace(decode(args[1]), "\x00", ":", -1)
+			}
+			s.mu.Lock()
+			s.users = append(s.users, user)
+			s.mu.Unlock()
+			c.PrintfLine("235 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			b, _ := c.ReadDotBytes()
+			s.mu.Lock()
+			s.mails = append(s.mails, string(b))
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+// selfSigned returns a TLS config for 127.0.0.1 and the pool to verify it.
+func selfSigned(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestSMTPImplicitTLSLoginAuth(t *testing.T) {
+	config, pool := selfSigned(t)
+	srv := newFakeSMTP(t, config, "LOGIN PLAIN")
+	defer srv.ln.Close()
+
+	s := &SMTP{Addr: srv.Addr(), TLS: TLSImplicit, Auth: AuthLogin, Username: "me", Password: "pw"}
+	if err := s.Send("me@example.com", []string{"a@example.com"}, []byte("hi")); err == nil {
+		t.Errorf("Send without the CA succeeded, want error")
+	}
+
+	s.RootCAs = pool
+	s.IdleTimeout = time.Minute
+	for i := 0; i < 2; i++ {
+		if err := s.Send("me@example.com", []string{"a@example.com"}, []byte(fmt.Sprintf("mail %d", i))); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// One for the failed attempt and one reused for both emails.
+	if srv.conns != 2 {
+		t.Errorf("got %d connections, want 2", srv.conns)
+	}
+	if len(srv.users) != 1 || srv.users[0] != "me:pw" {
+		t.Errorf("got users %q, want me:pw once", srv.users)
+	}
+	if len(srv.mails) != 2 || !strings.HasPrefix(srv.mails[1], "mail 1") {
+		t.Errorf("got mails %q", srv.mails)
+	}
+}
+
+func TestSMTPNoAuth(t *testing.T) {
+	srv := newFakeSMTP(t, nil, "")
+	defer srv.ln.Close()
+	s := &SMTP{Addr: srv.Addr(), TLS: TLSNone, Auth: AuthNone}
+	for i := 0; i < 2; i++ {
+		if err := s.Send("me@example.com", []string{"a@example.com"}, []byte("hi")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	srv.mu.Lock()
+	if srv.conns != 2 || len(srv.mails) != 2 {
+		t.Errorf("got %d connections and %d mails, want 2 each without IdleTimeout", srv.conns, len(srv.mails))
+	}
+	srv.mu.Unlock()
+
+	s = &SMTP{Addr: srv.Addr(), TLS: TLSStartTLS, Auth: AuthNone}
+	if err := s.Send("me@example.com", []string{"a@example.com"}, []byte("hi")); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Send returned %v, want the STARTTLS error", err)
+	}
+	s = &SMTP{Addr: srv.Addr(), TLS: TLSNone, Auth: AuthPlain}
+	if err := s.Send("me@example.com", []string{"a@example.com"}, []byte("hi")); err == nil || !strings.Contains(err.Error(), "AUTH") {
+		t.Errorf("Send returned %v, want the AUTH error", err)
+	}
+}
+
+func TestSMTPXOAUTH2(t *testing.T) {
+	srv := newFakeSMTP(t, nil, "XOAUTH2")
+	defer srv.ln.Close()
+	s := &SMTP{Addr: srv.Addr(), TLS: TLSNone, Auth: AuthXOAUTH2, Username: "me@example.com", Password: "token"}
+	if err := s.Send("me@example.com", []string{"a@example.com"}, []byte("hi")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if want := "user=me@example.com\x01auth=Bearer token\x01\x01"; len(srv.users) != 1 || srv.users[0] != want {
+		t.Errorf("got users %q, want %q", srv.users, want)
+	}
+}
+
+// fakeSender records the emails instead of sending them.
+type fakeSender struct {
+	mails []string
+	// fail, if set, fails the emails that contain it.
+	fail string
+}
+
+func (f *fakeSender) Send(from string, to []string, msg []byte) error {
+	if f.fail != "" && strings.Contains(string(msg), f.fail) {
+		return errors.New("failed")
+	}
+	f.mails = append(f.mails, string(msg))
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	f := &fakeSender{}
+	m := &Email{From: "me@example.com", To: []string{"a@example.com"}, Sender: f, Detail: true}
+	msgs := []*wechat.AddMsg{
+		{MsgType: wechat.MsgTypeText, NickName: "Alice", Content: "hi"},
+		{MsgType: wechat.MsgTypeText, NickName: "Bob", Content: "hello"},
+		{MsgType: wechat.MsgTypeText, NickName: "Alice", Content: "again"},
+	}
+	if err := m.Notify(context.Background(), msgs); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(f.mails) != 2 {
+		t.Fatalf("sent %d emails, want one per conversation", len(f.mails))
+	}
+	if !strings.Contains(f.mails[0], "Subject: WeChat: Alice") || !strings.Contains(f.mails[0], "again") {
+		t.Errorf("first email = %q, want both messages of Alice", f.mails[0])
+	}
+
+	f.mails = nil
+	m.Detail = false
+	if err := m.Notify(context.Background(), msgs); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(f.mails) != 1 || strings.Contains(f.mails[0], "hello") {
+		t.Errorf("sent %q, want one email without the content", f.mails)
+	}
+}
+
+func TestNotifyPartial(t *testing.T) {
+	f := &fakeSender{fail: "Subject: WeChat: Bob"}
+	m := &Email{From: "me@example.com", To: []string{"a@example.com"}, Sender: f, Detail: true}
+	s := &notify.Sink{Name: "email", Notifier: m}
+	s.Add(&wechat.AddMsg{MsgType: wechat.MsgTypeText, NickName: "Alice", Content: "hi"})
+	s.Add(&wechat.AddMsg{MsgType: wechat.MsgTypeText, NickName: "Bob", Content: "hello"})
+	if err := s.Flush(context.Background()); err == nil {
+		t.Errorf("Flush succeeded, want the error of Bob")
+	}
+	if len(f.mails) != 1 || !strings.Contains(f.mails[0], "Subject: WeChat: Alice") {
+		t.Fatalf("sent %d emails, want the one of Alice", len(f.mails))
+	}
+
+	f.mails, f.fail = nil, ""
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(f.mails) != 1 || !strings.Contains(f.mails[0], "Subject: WeChat: Bob") {
+		t.Errorf("retried %d emails, want only the one of Bob", len(f.mails))
+	}
+}
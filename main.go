@@ -1,139 +1,486 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/huangw5/webwx/api"
+	"github.com/huangw5/webwx/archive"
+	"github.com/huangw5/webwx/autoreply"
+	"github.com/huangw5/webwx/config"
 	"github.com/huangw5/webwx/email"
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/webhook"
 	"github.com/huangw5/webwx/wechat"
 )
 
-const (
-	notifyInterval = time.Minute
-)
-
 var (
-	appid    = flag.String("appid", "wx782c26e4c19acffb", "App ID")
-	from     = flag.String("from", "", "Email sender")
-	to       = flag.String("to", "", "Email recipient")
-	password = flag.String("password", "", "Email password")
-	smtpAddr = flag.String("smtp", "smtp.gmail.com:587", "SMTP Address")
-	detail   = flag.Bool("detail", true, "Wether or not show detailed messages in emails")
-	forward  = flag.String("forward", "", "The nickname to which the messages are forwarded")
+	configPath      = flag.String("config", "", "The YAML config file. The other flags override it")
+	appid           = flag.String("appid", config.DefaultAppID, "App ID")
+	from            = flag.String("from", "", "Email sender")
+	to              = flag.String("to", "", "Comma-separated email recipients")
+	password        = flag.String("password", "", "Email password. Prefer -password_file, as flags show up in ps")
+	passwordFile    = flag.String("password_file", "", "The file with the email password")
+	smtpAddr        = flag.String("smtp", config.DefaultSMTP, "SMTP Address")
+	detail          = flag.Bool("detail", true, "Wether or not show detailed messages in emails")
+	emailInterval   = flag.Duration("email_interval", config.DefaultEmailInterval, "How often new messages are emailed")
+	forward         = flag.String("forward", "", "The remark name, nickname or alias to which the messages are forwarded")
+	forwardInterval = flag.Duration("forward_interval", config.DefaultForwardInterval, "How often new messages are forwarded")
+	webhookURL      = flag.String("webhook", "", "The URL to which the messages are posted as JSON")
+	webhookTmpl     = flag.String("webhook_template", "", "The file with the text/template of the webhook body")
+	webhookSecret   = flag.String("webhook_secret", "", "The secret to sign the webhook body with")
+	webhookInterval = flag.Duration("webhook_interval", config.DefaultWebhookInterval, "How often new messages are posted to the webhook")
+	autoReply       = flag.String("autoreply", "", "The YAML or JSON file with the auto-reply rules. It is reloaded when changed")
+	archivePath     = flag.String("archive", "", "The database file to archive messages and contacts to. The search command reads it")
+	mediaDir        = flag.String("media_dir", "", "The directory to save images, voices, videos and files of archived messages to")
+	retries         = flag.Int("retries", wechat.DefaultRetryPolicy.MaxAttempts, "How many times to try each WeChat API call")
+	retryDelay      = flag.Duration("retry_delay", wechat.DefaultRetryPolicy.InitialDelay, "How long to wait before the first retry. It doubles on each retry")
+	session         = flag.String("session", "", "The file to save the login session to and resume it from")
+	record          = flag.String("record", "", "The file to append every WeChat request and response to as JSON lines, with the session secrets redacted")
+	qrMode          = flag.String("qr", "file", "How to show the login QR code: file or terminal")
+	listen          = flag.String("listen", config.DefaultListen, "The address the serve command listens on")
+	apiToken        = flag.String("api_token", "", "The bearer token the serve command requires. Defaults to $WEBWX_API_TOKEN")
 )
 
-func sendEmail(m *email.Email, msgChan chan *wechat.AddMsg) error {
-	var l []string
-	for i := 0; i < len(msgChan); i++ {
-		msg := <-msgChan
-		l = append(l, fmt.Sprintf("%s: %s", msg.NickName, msg.Content))
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [serve | search [search flags] [words...]]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command, notifies of new messages. serve also exposes the account as an HTTP API on -listen.\n")
+	fmt.Fprintf(os.Stderr, "search prints the messages in -archive. Run \"search -h\" for its flags.\n\n")
+	flag.PrintDefaults()
+}
+
+// scanNotifier is a QRPresenter that also emails that the QR code must be
+// scanned, once per login.
+type scanNotifier struct {
+	wechat.QRPresenter
+	email *email.Email
+
+	mu       sync.Mutex
+	notified bool
+}
+
+// Present implements wechat.QRPresenter.
+func (s *scanNotifier) Present(loginURL string, img []byte) error {
+	if err := s.QRPresenter.Present(loginURL, img); err != nil {
+		return err
 	}
-	body := strings.Join(l, "\n")
-	if !*detail {
-		body = ""
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.notified {
+		return nil
 	}
-	if err := m.Send([]string{*to}, "New WeChat messages", body); err != nil {
-		return err
+	s.notified = true
+	glog.Warningf("Logged out. Scan the QR code to log in again")
+	if s.email == nil {
+		return nil
+	}
+	body := fmt.Sprintf("WeChat logged out and could not log in again from the phone.\n"+
+		"Scan the QR code to log in again. It encodes %s", loginURL)
+	if err := s.email.Send(s.email.To, "WeChat needs a QR code scan", body); err != nil {
+		glog.Warningf("Failed to send email: %v", err)
 	}
-	glog.Infof("Successfully sent to %s", *to)
 	return nil
 }
 
-func forwardMsg(w *wechat.Wechat, toUserName string, msgChan chan *wechat.AddMsg) error {
-	var l []string
-	for i := 0; i < len(msgChan); i++ {
-		msg := <-msgChan
-		l = append(l, fmt.Sprintf("%s: %s", msg.NickName, msg.Content))
+func (s *scanNotifier) onLoginEvent(e *wechat.LoginEvent) {
+	if e.State == wechat.LoginConfirmed {
+		s.mu.Lock()
+		s.notified = false
+		s.mu.Unlock()
+	}
+}
+
+// loadConfig returns the config from -config, overridden by the flags set on
+// the command line.
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *configPath != "" {
+		var err error
+		if cfg, err = config.Load(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	var hook *config.Webhook
+	webhook := func() *config.Webhook {
+		if hook == nil {
+			if len(cfg.Webhooks) == 0 {
+				cfg.Webhooks = append(cfg.Webhooks, &config.Webhook{})
+			}
+			hook = cfg.Webhooks[0]
+		}
+		return hook
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "appid":
+			cfg.AppID = *appid
+		case "from":
+			cfg.EmailConfig().From = *from
+		case "to":
+			cfg.EmailConfig().To = strings.Split(*to, ",")
+		case "password":
+			cfg.EmailConfig().SetPassword(*password)
+		case "password_file":
+			cfg.EmailConfig().SetPasswordFile(*passwordFile)
+		case "forward":
+			cfg.Forward = []*config.Forward{{To: *forward}}
+		case "webhook":
+			webhook().URL = *webhookURL
+		case "webhook_template":
+			webhook().Template = *webhookTmpl
+		case "webhook_secret":
+			webhook().SetSecret(*webhookSecret)
+		case "webhook_interval":
+			webhook().Interval = config.Duration(*webhookInterval)
+		case "autoreply":
+			cfg.AutoReply = *autoReply
+		case "archive":
+			cfg.Archive = *archivePath
+		case "media_dir":
+			cfg.MediaDir = *mediaDir
+		case "retries":
+			cfg.Retries = *retries
+		case "retry_delay":
+			cfg.RetryDelay = config.Duration(*retryDelay)
+		case "session":
+			cfg.Session = *session
+		case "record":
+			cfg.Record = *record
+		case "qr":
+			cfg.QR = *qrMode
+		case "listen":
+			cfg.API.Listen = *listen
+		case "api_token":
+			cfg.API.Token = *apiToken
+		}
+	})
+	// The options of the sinks apply once the flags above set them up.
+	flag.Visit(func(f *flag.Flag) {
+		e := cfg.Email
+		switch {
+		case f.Name == "forward_interval":
+			for _, fw := range cfg.Forward {
+				fw.Interval = config.Duration(*forwardInterval)
+			}
+		case e == nil:
+		case f.Name == "smtp":
+			e.SMTP = *smtpAddr
+		case f.Name == "detail":
+			e.Detail = detail
+		case f.Name == "email_interval":
+			e.Interval = config.Duration(*emailInterval)
+		}
+	})
+	if cfg.API.Token == "" && cfg.API.TokenFile == "" {
+		cfg.API.Token = os.Getenv("WEBWX_API_TOKEN")
+	}
+	return cfg, nil
+}
+
+// image returns the image of msg, from the media saved to the archive if
+// it is there already.
+func image(ctx context.Context, w *wechat.Wechat, arch *archive.Archive, msg *wechat.AddMsg) ([]byte, error) {
+	if arch != nil {
+		if r, err := arch.Get(msg.MsgID); err == nil && r != nil && r.MediaPath != "" {
+			if b, err := ioutil.ReadFile(r.MediaPath); err == nil {
+				return b, nil
+			}
+		}
 	}
-	body := strings.Join(l, "\n")
-	toSend := &wechat.Msg{
-		Content:    body,
-		ToUserName: toUserName,
-		Type:       1,
+	var b bytes.Buffer
+	if err := w.GetMsgImageContext(ctx, msg.MsgID, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// saveMedia downloads the media of msg, if any, to dir and records the path
+// in the archive.
+func saveMedia(ctx context.Context, w *wechat.Wechat, arch *archive.Archive, dir string, msg *wechat.AddMsg) {
+	var get func(io.Writer) error
+	var name string
+	switch {
+	case msg.MsgType == wechat.MsgTypeImage:
+		name = msg.MsgID + ".jpg"
+		get = func(out io.Writer) error { return w.GetMsgImageContext(ctx, msg.MsgID, out) }
+	case msg.MsgType == wechat.MsgTypeVoice:
+		name = msg.MsgID + ".mp3"
+		get = func(out io.Writer) error { return w.GetVoiceContext(ctx, msg.MsgID, out) }
+	case msg.MsgType == wechat.MsgTypeVideo || msg.MsgType == wechat.MsgTypeMicroVideo:
+		name = msg.MsgID + ".mp4"
+		get = func(out io.Writer) error { return w.GetVideoContext(ctx, msg.MsgID, out) }
+	case msg.MsgType == wechat.MsgTypeApp && msg.AppMsgType == wechat.AppMsgTypeFile:
+		name = msg.MsgID + "_" + filepath.Base(msg.FileName)
+		get = func(out io.Writer) error { return w.GetMediaContext(ctx, msg, out) }
+	default:
+		return
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		glog.Warningf("Failed to save media of %s: %v", msg.MsgID, err)
+		return
+	}
+	err = get(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		glog.Warningf("Failed to save media of %s: %v", msg.MsgID, err)
+		os.Remove(path)
+		return
+	}
+	if err := arch.SetMediaPath(msg.MsgID, path); err != nil {
+		glog.Warningf("Failed to archive media path of %s: %v", msg.MsgID, err)
 	}
-	return w.SendMsg(toSend)
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		glog.Exitf("Failed to load config: %v", err)
+	}
+	serve := false
+	switch flag.Arg(0) {
+	case "":
+	case "serve":
+		serve = true
+	case "search":
+		if err := search(cfg.Archive, flag.Args()[1:]); err != nil {
+			glog.Exitf("Failed to search: %v", err)
+		}
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
 	flag.Lookup("alsologtostderr").Value.Set("true")
+	if err := cfg.Validate(); err != nil {
+		glog.Exitf("%v", err)
+	}
 
 	var m *email.Email
-	if *from != "" && *to != "" && *password != "" {
+	if e := cfg.Email; e != nil {
+		sender := &email.SMTP{
+			Addr:        e.SMTP,
+			TLS:         email.TLSMode(e.TLS),
+			Auth:        email.AuthMechanism(e.Auth),
+			Username:    e.Username,
+			Password:    e.Password,
+			IdleTimeout: time.Duration(e.IdleTimeout),
+		}
+		if e.CAFile != "" {
+			var err error
+			if sender.RootCAs, err = email.LoadCertPool(e.CAFile); err != nil {
+				glog.Exitf("Failed to load email.ca_file: %v", err)
+			}
+		}
+		defer sender.Close()
 		m = &email.Email{
-			From:     *from,
-			Pass:     *password,
-			SMTPAddr: *smtpAddr,
+			From:     e.From,
+			Pass:     e.Password,
+			SMTPAddr: e.SMTP,
+			Sender:   sender,
+			To:       e.To,
+			Detail:   e.ShowDetail(),
 		}
-		glog.Infof("New messages will be sent to %s", *to)
+		glog.Infof("New messages will be sent to %s", strings.Join(e.To, ", "))
 	}
-	if *forward != "" {
-		glog.Infof("New messages will be forwarded to %s", *forward)
+	for _, f := range cfg.Forward {
+		glog.Infof("New messages will be forwarded to %s", f.To)
 	}
 
 	c := wechat.NewClient()
+	if cfg.Record != "" {
+		f, err := os.OpenFile(cfg.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			glog.Exitf("Failed to open %s: %v", cfg.Record, err)
+		}
+		defer f.Close()
+		c = wechat.NewRecorder(c, f)
+		glog.Infof("Recording the WeChat traffic to %s", cfg.Record)
+	}
+	retry := *wechat.DefaultRetryPolicy
+	retry.MaxAttempts = cfg.Retries
+	retry.InitialDelay = time.Duration(cfg.RetryDelay)
 	w := &wechat.Wechat{
-		Client: c,
-		AppID:  *appid,
+		Client:      c,
+		AppID:       cfg.AppID,
+		SessionFile: cfg.Session,
+		RetryPolicy: &retry,
+	}
+	switch cfg.QR {
+	case "file":
+		w.QRPresenter = &wechat.FilePresenter{Path: "QR.jpg"}
+	case "terminal":
+		w.QRPresenter = &wechat.TerminalPresenter{}
 	}
-	if err := w.Login(); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		glog.Infof("Got %v, shutting down", <-sigs)
+		cancel()
+	}()
+
+	if err := w.ResumeContext(ctx); err != nil {
 		glog.Exitf("Failed to login: %v", err)
 	}
+	// From now on, nobody is watching for the QR code.
+	scan := &scanNotifier{QRPresenter: w.QRPresenter, email: m}
+	w.QRPresenter = scan
+	w.OnLoginEvent = scan.onLoginEvent
+	w.AutoRelogin = true
+
+	notifiers := &notify.Dispatcher{}
+	if m != nil {
+		notifiers.Add("email", m, time.Duration(cfg.Email.Interval))
+	}
+	for i, f := range cfg.Forward {
+		notifiers.Add(fmt.Sprintf("forward[%d]", i), &notify.Forward{Wechat: w, To: f.To}, time.Duration(f.Interval))
+	}
+	for i, hc := range cfg.Webhooks {
+		h := &webhook.Webhook{
+			URL:         hc.URL,
+			Headers:     hc.Headers,
+			Secret:      []byte(hc.Secret),
+			MaxAttempts: hc.MaxAttempts,
+			Contacts:    w.Contacts,
+		}
+		if hc.Template != "" {
+			b, err := ioutil.ReadFile(hc.Template)
+			if err != nil {
+				glog.Exitf("Failed to read webhook template: %v", err)
+			}
+			if h.Template, err = webhook.ParseTemplate(string(b)); err != nil {
+				glog.Exitf("Failed to parse webhook template: %v", err)
+			}
+		}
+		notifiers.Add(fmt.Sprintf("webhook[%d]", i), h, time.Duration(hc.Interval))
+		glog.Infof("New messages will be posted to %s", hc.URL)
+	}
+
+	var arch *archive.Archive
+	if cfg.Archive != "" {
+		var err error
+		if arch, err = archive.Open(cfg.Archive); err != nil {
+			glog.Exitf("Failed to open archive: %v", err)
+		}
+		defer arch.Close()
+		if err := arch.SaveContacts(w.Contacts.Members()); err != nil {
+			glog.Warningf("Failed to archive contacts: %v", err)
+		}
+		glog.Infof("Messages will be archived to %s", cfg.Archive)
+	}
+	if m != nil {
+		m.Image = func(ctx context.Context, msg *wechat.AddMsg) ([]byte, error) {
+			return image(ctx, w, arch, msg)
+		}
+	}
+	go notifiers.Run(ctx)
+
+	var replier *autoreply.Engine
+	if cfg.AutoReply != "" {
+		var err error
+		if replier, err = autoreply.NewEngine(w, cfg.AutoReply); err != nil {
+			glog.Exitf("Failed to load auto-reply rules: %v", err)
+		}
+		go replier.Watch(ctx, 5*time.Second)
+	}
 
-	allMessages := make(map[string]bool)
-	msgChan := make(chan *wechat.AddMsg, 9999)
-	notifyChan := time.NewTicker(notifyInterval).C
+	var server *api.Server
+	if serve {
+		if cfg.API.Token == "" {
+			glog.Warningf("Serving the API without -api_token. Anyone who can reach %s can use the account", cfg.API.Listen)
+		}
+		server = api.NewServer(w, cfg.API.Token)
+		server.Archive = arch
+		go func() {
+			if err := server.ListenAndServe(ctx, cfg.API.Listen); err != nil {
+				glog.Exitf("Failed to serve API: %v", err)
+			}
+		}()
+	}
+
+	events := make(chan *wechat.Event)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- w.Run(ctx, events)
+	}()
 	for {
 		select {
-		case <-notifyChan:
-			if len(msgChan) > 0 {
-				if m != nil {
-					if err := sendEmail(m, msgChan); err != nil {
-						glog.Warningf("Failed to send email: %v", err)
+		case <-ctx.Done():
+			return
+		case err := <-runErr:
+			if ctx.Err() != nil {
+				return
+			}
+			glog.Exitf("Sync loop stopped: %v", err)
+		case e := <-events:
+			switch e.Type {
+			case wechat.LogoutEvent:
+				glog.Warningf("Session ended: %v", e.Err)
+			case wechat.ReloginEvent:
+				glog.Infof("Logged in again")
+				if arch != nil {
+					if err := arch.SaveContacts(w.Contacts.Members()); err != nil {
+						glog.Warningf("Failed to archive contacts: %v", err)
 					}
 				}
-				if user, ok := w.Contacts[*forward]; *forward != "" && ok {
-					if err := forwardMsg(w, user.UserName, msgChan); err != nil {
-						glog.Warningf("Failed to forward: %v")
+			case wechat.ErrorEvent:
+				glog.Errorf("Sync failed: %v", e.Err)
+			case wechat.ContactEvent:
+				if arch != nil {
+					if err := arch.SaveContacts(e.ModContacts); err != nil {
+						glog.Warningf("Failed to archive contacts: %v", err)
 					}
-				} else {
-					glog.Warningf("Unable to forward to: %v", user)
 				}
-			}
-		default:
-			sr, err := w.SyncCheck()
-			if err != nil || sr.Retcode != "0" {
-				if m != nil {
-					m.Send([]string{*to}, fmt.Sprintf("SyncCheck failed -- Res: %+v, err: %v", sr, err), "")
+			case wechat.MessageEvent:
+				msg := e.Msg
+				if server != nil {
+					server.Publish(msg)
 				}
-				glog.Exitf("SyncCheck failed -- Res: %+v, err: %v", sr, err)
-			}
-			if sr.Selector == "0" {
-				continue
-			}
-			ws, err := w.WebwxSync()
-			if err != nil {
-				glog.Errorf("WebwxSync failed: %v", err)
-				continue
-			}
-			for _, msg := range ws.AddMsgList {
-				if msg.MsgType != 1 && msg.MsgType != 3 && msg.MsgType != 34 && msg.MsgType != 43 && msg.MsgType != 62 && msg.MsgType != 47 {
+				if arch != nil {
+					if err := arch.Add(msg, notify.Describe(msg)); err != nil {
+						glog.Warningf("Failed to archive message %s: %v", msg.MsgID, err)
+					} else if cfg.MediaDir != "" {
+						go saveMedia(ctx, w, arch, cfg.MediaDir, msg)
+					}
+				}
+				switch msg.MsgType {
+				case wechat.MsgTypeText, wechat.MsgTypeImage, wechat.MsgTypeVoice, wechat.MsgTypeVideo, wechat.MsgTypeMicroVideo, wechat.MsgTypeEmoticon:
+				default:
 					// Skip non-displayable messages.
 					continue
 				}
-				if _, ok := allMessages[msg.MsgID]; !ok {
-					allMessages[msg.MsgID] = true
-					glog.Info(fmt.Sprintf("%s: %s", msg.NickName, msg.Content))
-					// Do not notify group chat messages.
-					if !strings.HasPrefix(msg.FromUserName, "@@") {
-						msgChan <- msg
-					}
+				if replier != nil {
+					go func() {
+						if _, err := replier.Handle(ctx, msg); err != nil {
+							glog.Warningf("Failed to auto-reply: %v", err)
+						}
+					}()
+				}
+				glog.Info(fmt.Sprintf("%s: %s", notify.Sender(msg), notify.Describe(msg)))
+				// Only notify group chat messages that mention me.
+				if !strings.HasPrefix(msg.FromUserName, "@@") || msg.MentionedMe {
+					notifiers.Publish(msg)
 				}
 			}
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
 }
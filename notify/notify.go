@@ -0,0 +1,196 @@
+// Package notify delivers new WeChat messages to sinks like email, in
+// batches.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/huangw5/webwx/wechat"
+)
+
+// Notifier delivers a batch of messages somewhere.
+type Notifier interface {
+	Notify(ctx context.Context, msgs []*wechat.AddMsg) error
+}
+
+// Func is a function that implements Notifier.
+type Func func(ctx context.Context, msgs []*wechat.AddMsg) error
+
+// Notify implements Notifier.
+func (f Func) Notify(ctx context.Context, msgs []*wechat.AddMsg) error {
+	return f(ctx, msgs)
+}
+
+// PartialError is returned by a Notifier that delivered only some of the
+// messages. Sink keeps only Failed for the next flush.
+type PartialError struct {
+	// Failed are the messages worth delivering again.
+	Failed []*wechat.AddMsg
+	Err    error
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+
+// Unwrap returns e.Err.
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// Sender returns who sent msg, including the group for group messages.
+func Sender(msg *wechat.AddMsg) string {
+	if msg.GroupNickName != "" {
+		return fmt.Sprintf("%s@%s", msg.NickName, msg.GroupNickName)
+	}
+	return msg.NickName
+}
+
+// Describe returns a human readable text of msg.
+func Describe(msg *wechat.AddMsg) string {
+	m, err := wechat.Decode(msg)
+	if err != nil {
+		return msg.Content
+	}
+	return m.String()
+}
+
+// Format returns msgs as text, one "sender: text" line per message.
+func Format(msgs []*wechat.AddMsg) string {
+	var l []string
+	for _, msg := range msgs {
+		l = append(l, fmt.Sprintf("%s: %s", Sender(msg), Describe(msg)))
+	}
+	return strings.Join(l, "\n")
+}
+
+// maxPending is how many messages a Sink keeps for the next flush after
+// failed deliveries. The oldest ones are dropped beyond that.
+const maxPending = 1000
+
+// Sink batches messages for a Notifier.
+type Sink struct {
+	// Name is used in logs.
+	Name     string
+	Notifier Notifier
+	// Interval is how often the batched messages are delivered.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	pending []*wechat.AddMsg
+}
+
+// Add queues msg for the next batch.
+func (s *Sink) Add(msg *wechat.AddMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, msg)
+}
+
+// Flush delivers the queued messages, if any. On failure, they are kept for
+// the next flush, or only the failed ones if the Notifier returns a
+// PartialError.
+func (s *Sink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	msgs := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := s.Notifier.Notify(ctx, msgs); err != nil {
+		failed := msgs
+		var pe *PartialError
+		if errors.As(err, &pe) {
+			failed = pe.Failed
+		}
+		s.requeue(failed)
+		return fmt.Errorf("error on notifying %s of %d messages: %v", s.Name, len(msgs), err)
+	}
+	glog.Infof("Successfully notified %s of %d messages", s.Name, len(msgs))
+	return nil
+}
+
+// requeue puts msgs back in front of the queue, dropping the oldest messages
+// beyond maxPending.
+func (s *Sink) requeue(msgs []*wechat.AddMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(append([]*wechat.AddMsg(nil), msgs...), s.pending...)
+	if n := len(s.pending) - maxPending; n > 0 {
+		glog.Warningf("Dropped %d messages for %s after failed deliveries", n, s.Name)
+		s.pending = s.pending[n:]
+	}
+}
+
+// Run flushes every Interval until ctx is done.
+func (s *Sink) Run(ctx context.Context) {
+	t := time.NewTicker(s.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.Flush(ctx); err != nil {
+				glog.Warningf("%v", err)
+			}
+		}
+	}
+}
+
+// Dispatcher sends each message to all its sinks.
+type Dispatcher struct {
+	Sinks []*Sink
+}
+
+// Add adds a sink that delivers to n every interval.
+func (d *Dispatcher) Add(name string, n Notifier, interval time.Duration) {
+	d.Sinks = append(d.Sinks, &Sink{Name: name, Notifier: n, Interval: interval})
+}
+
+// Publish queues msg on every sink.
+func (d *Dispatcher) Publish(msg *wechat.AddMsg) {
+	for _, s := range d.Sinks {
+		s.Add(msg)
+	}
+}
+
+// Run runs all sinks until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range d.Sinks {
+		wg.Add(1)
+		go func(s *Sink) {
+			defer wg.Done()
+			s.Run(ctx)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// Forward is a Notifier that forwards messages to a WeChat contact.
+type Forward struct {
+	Wechat *wechat.Wechat
+	// To is the remark name, nickname or alias of the contact.
+	To string
+}
+
+// Notify implements Notifier. The contact is looked up every time, so it
+// follows renames.
+func (f *Forward) Notify(ctx context.Context, msgs []*wechat.AddMsg) error {
+	if f.Wechat == nil || f.Wechat.Contacts == nil {
+		return fmt.Errorf("unable to forward to %s: not logged in", f.To)
+	}
+	user, err := f.Wechat.Contacts.Lookup(f.To)
+	if err != nil {
+		return fmt.Errorf("unable to forward to %s: %v", f.To, err)
+	}
+	return f.Wechat.SendMsgContext(ctx, &wechat.Msg{
+		Content:    Format(msgs),
+		ToUserName: user.UserName,
+		Type:       wechat.MsgTypeText,
+	})
+}
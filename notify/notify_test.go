@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+func TestFormat(t *testing.T) {
+	msgs := []*wechat.AddMsg{
+		{MsgType: wechat.MsgTypeText, Content: "hi &amp; bye", NickName: "Alice"},
+		{MsgType: wechat.MsgTypeText, Content: "yo", NickName: "Bob", GroupNickName: "Team"},
+	}
+	want := "Alice: hi & bye\nBob@Team: yo"
+	if got := Format(msgs); got != want {
+		t.Errorf("Format = %q, want %q", got, want)
+	}
+}
+
+func TestSinkFlush(t *testing.T) {
+	var got [][]*wechat.AddMsg
+	fail := false
+	s := &Sink{Name: "test", Notifier: Func(func(ctx context.Context, msgs []*wechat.AddMsg) error {
+		got = append(got, msgs)
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})}
+	if err := s.Flush(context.Background()); err != nil || len(got) != 0 {
+		t.Errorf("Flush of empty sink = %v, notified %d times", err, len(got))
+	}
+
+	d := &Dispatcher{Sinks: []*Sink{s}}
+	d.Publish(&wechat.AddMsg{MsgID: "1"})
+	d.Publish(&wechat.AddMsg{MsgID: "2"})
+	if err := s.Flush(context.Background()); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	if len(got) != 1 || len(got[0]) != 2 {
+		t.Fatalf("notified %v, want one batch of 2", got)
+	}
+
+	fail = true
+	d.Publish(&wechat.AddMsg{MsgID: "3"})
+	if err := s.Flush(context.Background()); err == nil {
+		t.Errorf("Flush succeeded, want error")
+	}
+	if len(s.pending) != 1 {
+		t.Errorf("pending = %d after failed Flush, want the batch kept", len(s.pending))
+	}
+
+	fail = false
+	d.Publish(&wechat.AddMsg{MsgID: "4"})
+	if err := s.Flush(context.Background()); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	if last := got[len(got)-1]; len(last) != 2 || last[0].MsgID != "3" || last[1].MsgID != "4" {
+		t.Errorf("notified %v, want the failed message before the new one", last)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %d after Flush, want 0", len(s.pending))
+	}
+}
+
+func TestSinkFlushDrops(t *testing.T) {
+	s := &Sink{Name: "test", Notifier: Func(func(ctx context.Context, msgs []*wechat.AddMsg) error {
+		return errors.New("failed")
+	})}
+	for i := 0; i < maxPending+10; i++ {
+		s.Add(&wechat.AddMsg{MsgID: fmt.Sprint(i)})
+	}
+	if err := s.Flush(context.Background()); err == nil {
+		t.Errorf("Flush succeeded, want error")
+	}
+	if len(s.pending) != maxPending || s.pending[0].MsgID != "10" {
+		t.Errorf("kept %d messages from %s, want the latest %d", len(s.pending), s.pending[0].MsgID, maxPending)
+	}
+}
+
+func TestSinkFlushPartial(t *testing.T) {
+	s := &Sink{Name: "test", Notifier: Func(func(ctx context.Context, msgs []*wechat.AddMsg) error {
+		return &PartialError{Failed: msgs[1:], Err: errors.New("failed")}
+	})}
+	s.Add(&wechat.AddMsg{MsgID: "1"})
+	s.Add(&wechat.AddMsg{MsgID: "2"})
+	if err := s.Flush(context.Background()); err == nil {
+		t.Errorf("Flush succeeded, want error")
+	}
+	if len(s.pending) != 1 || s.pending[0].MsgID != "2" {
+		t.Errorf("pending = %v, want only the failed message", s.pending)
+	}
+}
+
+func TestForwardNotLoggedIn(t *testing.T) {
+	f := &Forward{Wechat: &wechat.Wechat{}, To: "Alice"}
+	if err := f.Notify(context.Background(), []*wechat.AddMsg{{MsgID: "1"}}); err == nil {
+		t.Errorf("Notify succeeded without contacts, want error")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/huangw5/webwx/archive"
+	"github.com/huangw5/webwx/notify"
+)
+
+// parseTime parses a time like "2006-01-02" or "2006-01-02 15:04" in local
+// time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want like 2006-01-02 15:04", s)
+}
+
+// search runs the search command, which prints the archived messages that
+// match args. It opens the archive read-only, which still fails while a
+// running webwx holds it; use the /search endpoint of the API then.
+func search(archivePath string, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	contact := fs.String("contact", "", "The nickname, remark name or alias of the contact, for the messages to and from it")
+	group := fs.String("group", "", "The nickname of the group")
+	since := fs.String("since", "", "Only messages sent at or after, like 2006-01-02 15:04")
+	until := fs.String("until", "", "Only messages sent before, like 2006-01-02 15:04")
+	limit := fs.Int("limit", 100, "The max number of messages, the latest ones. 0 means no limit")
+	asJSON := fs.Bool("json", false, "Print one JSON record per line")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -archive <file> search [flags] [words...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The archive cannot be searched this way while webwx is running with it.\nUse the /search endpoint of the API then.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if archivePath == "" {
+		return fmt.Errorf("-archive or archive in -config is required")
+	}
+	q := &archive.Query{Contact: *contact, Group: *group, Limit: *limit}
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+	q.Text = strings.Join(fs.Args(), " ")
+
+	a, err := archive.OpenReadOnly(archivePath)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	res, err := a.Search(q)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range res {
+		if *asJSON {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			continue
+		}
+		line := fmt.Sprintf("%s %s: %s", r.Time().Format("2006-01-02 15:04:05"), notify.Sender(r.Msg), r.Text)
+		if r.MediaPath != "" {
+			line += " (" + r.MediaPath + ")"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
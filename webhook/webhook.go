@@ -0,0 +1,228 @@
+// Package webhook posts WeChat messages to HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
+)
+
+// DefaultTemplate is used when Webhook.Template is nil.
+const DefaultTemplate = `{"id":{{json .MsgID}},"type":{{.MsgType}},"time":{{.CreateTime}},` +
+	`"from":{{json .NickName}},"from_user":{{json .SenderUserName}},"remark":{{json .From.RemarkName}},` +
+	`"group":{{json .GroupNickName}},"mentioned":{{.MentionedMe}},"text":{{json .Text}}}`
+
+// DefaultSignatureHeader is used when Webhook.SignatureHeader is empty.
+const DefaultSignatureHeader = "X-Webhook-Signature"
+
+// Data is what the template is executed with. The AddMsg fields are
+// available directly, e.g. {{.NickName}}.
+type Data struct {
+	*wechat.AddMsg
+	// Text is the message as human readable text.
+	Text string
+	// From is the contact who sent the message. It is empty if unknown.
+	From *wechat.Member
+	// Group is the group chat of group messages. It is empty otherwise.
+	Group *wechat.Member
+}
+
+// ParseTemplate parses a payload template. Besides the builtins, it has
+// "json", which encodes its argument as JSON.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+var defaultTemplate = template.Must(ParseTemplate(DefaultTemplate))
+
+// Webhook is a notify.Notifier that POSTs each message as JSON to URL.
+// Example:
+//
+//	h := &webhook.Webhook{
+//		URL:     "https://example.com/hook",
+//		Headers: map[string]string{"Authorization": "Bearer xxx"},
+//		Secret:  []byte("xxx"),
+//	}
+type Webhook struct {
+	URL string
+	// Template renders the JSON body from a Data. Use ParseTemplate to
+	// create it. Defaults to DefaultTemplate.
+	Template *template.Template
+	// Headers are added to each request.
+	Headers map[string]string
+	// Secret, if set, signs the body with HMAC-SHA256. The signature is sent
+	// as "sha256=<hex>" in SignatureHeader.
+	Secret          []byte
+	SignatureHeader string
+	// Contacts, if set, is used to fill in Data.From and Data.Group.
+	Contacts *wechat.ContactBook
+	// MaxAttempts is the number of tries per message. Defaults to 3.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles on each retry.
+	// Defaults to 1s.
+	Backoff time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Notify implements notify.Notifier. Every message is posted even if some
+// fail, and the failed ones are returned in a notify.PartialError.
+func (h *Webhook) Notify(ctx context.Context, msgs []*wechat.AddMsg) error {
+	var failed []*wechat.AddMsg
+	var errs []string
+	for _, msg := range msgs {
+		body, err := h.Render(msg)
+		if err != nil {
+			// Posting it again would not fix the template.
+			errs = append(errs, fmt.Sprintf("message %s: %v", msg.MsgID, err))
+			continue
+		}
+		if err := h.post(ctx, body); err != nil {
+			failed = append(failed, msg)
+			errs = append(errs, fmt.Sprintf("message %s: %v", msg.MsgID, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &notify.PartialError{
+		Failed: failed,
+		Err:    fmt.Errorf("%d of %d messages failed: %s", len(errs), len(msgs), strings.Join(errs, "; ")),
+	}
+}
+
+var _ notify.Notifier = (*Webhook)(nil)
+
+// Render returns the JSON body for msg.
+func (h *Webhook) Render(msg *wechat.AddMsg) ([]byte, error) {
+	d := &Data{AddMsg: msg, Text: notify.Describe(msg), From: &wechat.Member{}, Group: &wechat.Member{}}
+	if h.Contacts != nil {
+		if m := h.Contacts.Get(msg.SenderUserName); m != nil {
+			d.From = m
+		}
+		if msg.GroupNickName != "" {
+			if g := h.Contacts.Get(msg.FromUserName); g != nil && g.IsGroup() {
+				d.Group = g
+				if m := g.GroupMember(msg.SenderUserName); m != nil && d.From.UserName == "" {
+					d.From = m
+				}
+			}
+		}
+	}
+	t := h.Template
+	if t == nil {
+		t = defaultTemplate
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		return nil, fmt.Errorf("error on executing template: %v", err)
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("template rendered invalid JSON: %s", b.String())
+	}
+	return b.Bytes(), nil
+}
+
+// Sign returns the signature of body with secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// statusError is a response with a status other than 2xx.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "HTTP status: " + e.status
+}
+
+// retryable returns whether err of postOnce is worth retrying: network
+// errors, 429 and 5xx.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var e *statusError
+	if errors.As(err, &e) {
+		return e.code == http.StatusTooManyRequests || e.code >= 500
+	}
+	return true
+}
+
+// post sends body, retrying on network errors, 429 and 5xx.
+func (h *Webhook) post(ctx context.Context, body []byte) error {
+	p := &wechat.RetryPolicy{
+		MaxAttempts:  h.MaxAttempts,
+		InitialDelay: h.Backoff,
+		Multiplier:   2,
+		Retryable:    retryable,
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = time.Second
+	}
+	return p.Do(ctx, "Webhook "+h.URL, func() error {
+		return h.postOnce(ctx, body)
+	})
+}
+
+func (h *Webhook) postOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(h.Secret) > 0 {
+		header := h.SignatureHeader
+		if header == "" {
+			header = DefaultSignatureHeader
+		}
+		req.Header.Set(header, Sign(h.Secret, body))
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error on POST: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	return &statusError{code: resp.StatusCode, status: resp.Status}
+}
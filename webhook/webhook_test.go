@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/notify"
+	"github.com/huangw5/webwx/wechat"
+)
+
+func TestRender(t *testing.T) {
+	contacts := wechat.NewContactBook([]*wechat.Member{
+		{UserName: "@a", NickName: "Alice", RemarkName: "Ally"},
+	})
+	h := &Webhook{Contacts: contacts}
+	body, err := h.Render(&wechat.AddMsg{
+		MsgID:          "1",
+		MsgType:        wechat.MsgTypeText,
+		Content:        `say "hi"`,
+		FromUserName:   "@a",
+		SenderUserName: "@a",
+		NickName:       "Alice",
+	})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", body, err)
+	}
+	if got["text"] != `say "hi"` || got["remark"] != "Ally" || got["from"] != "Alice" {
+		t.Errorf("Render = %s", body)
+	}
+
+	h.Template, err = ParseTemplate(`{"text": {{.Text}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Render(&wechat.AddMsg{MsgType: wechat.MsgTypeText, Content: "hi"}); err == nil {
+		t.Errorf("Render succeeded with invalid JSON")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := r.Header.Get(DefaultSignatureHeader), Sign([]byte("secret"), body); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+		if got := r.Header.Get("X-Token"); got != "abc" {
+			t.Errorf("X-Token = %s, want abc", got)
+		}
+	}))
+	defer srv.Close()
+
+	h := &Webhook{
+		URL:     srv.URL,
+		Headers: map[string]string{"X-Token": "abc"},
+		Secret:  []byte("secret"),
+		Backoff: time.Millisecond,
+	}
+	if err := h.Notify(context.Background(), []*wechat.AddMsg{{MsgType: wechat.MsgTypeText, Content: "hi"}}); err != nil {
+		t.Errorf("Notify: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+}
+
+func TestNotifyNoRetryOn4xx(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	h := &Webhook{URL: srv.URL, Backoff: time.Millisecond}
+	if err := h.Notify(context.Background(), []*wechat.AddMsg{{MsgType: wechat.MsgTypeText}}); err == nil {
+		t.Errorf("Notify succeeded, want error")
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestNotifyPartial(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&d)
+		got = append(got, d["id"].(string))
+		if d["id"] == "1" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	h := &Webhook{URL: srv.URL, MaxAttempts: 2, Backoff: time.Millisecond}
+	msgs := []*wechat.AddMsg{{MsgID: "1", MsgType: wechat.MsgTypeText}, {MsgID: "2", MsgType: wechat.MsgTypeText}}
+	err := h.Notify(context.Background(), msgs)
+	var pe *notify.PartialError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Notify = %v, want a PartialError", err)
+	}
+	if len(pe.Failed) != 1 || pe.Failed[0].MsgID != "1" {
+		t.Errorf("Failed = %v, want message 1", pe.Failed)
+	}
+	if want := []string{"1", "1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("posted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package wechat
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ContactType is the type of a contact.
+type ContactType int
+
+// The contact types.
+const (
+	// ContactFriend is a person.
+	ContactFriend ContactType = iota
+	// ContactGroup is a group chat.
+	ContactGroup
+	// ContactOfficial is an official account.
+	ContactOfficial
+	// ContactSpecial is a built-in account like filehelper.
+	ContactSpecial
+)
+
+func (t ContactType) String() string {
+	switch t {
+	case ContactFriend:
+		return "friend"
+	case ContactGroup:
+		return "group"
+	case ContactOfficial:
+		return "official"
+	case ContactSpecial:
+		return "special"
+	}
+	return fmt.Sprintf("ContactType(%d)", int(t))
+}
+
+// specialUserNames are the built-in accounts.
+var specialUserNames = map[string]bool{
+	"blogapp":               true,
+	"blogappweixin":         true,
+	"brandsessionholder":    true,
+	"facebookapp":           true,
+	"feedsapp":              true,
+	"filehelper":            true,
+	"floatbottle":           true,
+	"fmessage":              true,
+	"lbsapp":                true,
+	"masssendapp":           true,
+	"medianote":             true,
+	"meishiapp":             true,
+	"newsapp":               true,
+	"notification_messages": true,
+	"officialaccounts":      true,
+	"qmessage":              true,
+	"qqfriend":              true,
+	"qqmail":                true,
+	"qqsync":                true,
+	"readerapp":             true,
+	"shakeapp":              true,
+	"tmessage":              true,
+	"userexperience_alarm":  true,
+	"voip":                  true,
+	"weibo":                 true,
+	"weixin":                true,
+	"weixinreminder":        true,
+	"wxitil":                true,
+}
+
+// verifyFlagOfficial is set in Member.VerifyFlag of official accounts.
+const verifyFlagOfficial = 8
+
+// Type returns the type of m.
+func (m *Member) Type() ContactType {
+	switch {
+	case m.IsGroup():
+		return ContactGroup
+	case specialUserNames[m.UserName]:
+		return ContactSpecial
+	case m.VerifyFlag&verifyFlagOfficial != 0:
+		return ContactOfficial
+	}
+	return ContactFriend
+}
+
+// ContactBook holds contacts indexed by user name, nickname, remark name and
+// alias. It is safe for concurrent use.
+type ContactBook struct {
+	mu      sync.RWMutex
+	members map[string]*Member
+	// names maps nicknames, remark names and aliases to user names.
+	names map[string]map[string]bool
+}
+
+// NewContactBook returns a ContactBook with the given members.
+func NewContactBook(members []*Member) *ContactBook {
+	b := &ContactBook{}
+	b.Reset(members)
+	return b
+}
+
+// Reset replaces all contacts with members.
+func (b *ContactBook) Reset(members []*Member) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members = make(map[string]*Member)
+	b.names = make(map[string]map[string]bool)
+	for _, m := range members {
+		b.add(m)
+	}
+}
+
+// Add adds m, replacing the contact with the same user name if any.
+func (b *ContactBook) Add(m *Member) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(m)
+}
+
+func (b *ContactBook) add(m *Member) {
+	b.remove(m.UserName)
+	b.members[m.UserName] = m
+	for _, name := range []string{m.NickName, m.RemarkName, m.Alias} {
+		if name == "" {
+			continue
+		}
+		if b.names[name] == nil {
+			b.names[name] = make(map[string]bool)
+		}
+		b.names[name][m.UserName] = true
+	}
+}
+
+// Remove removes the contact with the given user name.
+func (b *ContactBook) Remove(userName string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(userName)
+}
+
+func (b *ContactBook) remove(userName string) {
+	m, ok := b.members[userName]
+	if !ok {
+		return
+	}
+	delete(b.members, userName)
+	for _, name := range []string{m.NickName, m.RemarkName, m.Alias} {
+		delete(b.names[name], userName)
+		if len(b.names[name]) == 0 {
+			delete(b.names, name)
+		}
+	}
+}
+
+// Get returns the contact with the given user name, or nil.
+func (b *ContactBook) Get(userName string) *Member {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.members[userName]
+}
+
+// Lookup returns the contact whose user name, remark name, nickname or alias
+// is name. It fails if there is no such contact or more than one.
+func (b *ContactBook) Lookup(name string) (*Member, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if m, ok := b.members[name]; ok {
+		return m, nil
+	}
+	var found []*Member
+	for userName := range b.names[name] {
+		found = append(found, b.members[userName])
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no contact named %q", name)
+	case 1:
+		return found[0], nil
+	}
+	// Prefer the remark name, which the user picked to be unique.
+	var remarked []*Member
+	for _, m := range found {
+		if m.RemarkName == name {
+			remarked = append(remarked, m)
+		}
+	}
+	if len(remarked) == 1 {
+		return remarked[0], nil
+	}
+	return nil, fmt.Errorf("%d contacts named %q", len(found), name)
+}
+
+// Members returns the contacts of the given types, or all contacts if no
+// type is given, sorted by user name.
+func (b *ContactBook) Members(types ...ContactType) []*Member {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var res []*Member
+	for _, m := range b.members {
+		if len(types) == 0 {
+			res = append(res, m)
+			continue
+		}
+		for _, t := range types {
+			if m.Type() == t {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UserName < res[j].UserName })
+	return res
+}
+
+// Len returns the number of contacts.
+func (b *ContactBook) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.members)
+}
@@ -0,0 +1,141 @@
+package wechat
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMemberType(t *testing.T) {
+	tests := []struct {
+		m    *Member
+		want ContactType
+	}{
+		{&Member{UserName: "@abc"}, ContactFriend},
+		{&Member{UserName: "@@abc"}, ContactGroup},
+		{&Member{UserName: "@abc", VerifyFlag: 24}, ContactOfficial},
+		{&Member{UserName: "filehelper"}, ContactSpecial},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Type(); got != tt.want {
+			t.Errorf("Type(%s) = %v, want %v", tt.m.UserName, got, tt.want)
+		}
+	}
+}
+
+func TestContactBookLookup(t *testing.T) {
+	b := NewContactBook([]*Member{
+		{UserName: "@a", NickName: "Alice", Alias: "alice01"},
+		{UserName: "@b", NickName: "Bob"},
+		{UserName: "@c", NickName: "Bob", RemarkName: "Bob"},
+		{UserName: "@d", NickName: "Dave"},
+		{UserName: "@e", NickName: "Dave"},
+	})
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "@a", want: "@a"},
+		{name: "Alice", want: "@a"},
+		{name: "alice01", want: "@a"},
+		{name: "Bob", want: "@c"},
+		{name: "Dave", wantErr: true},
+		{name: "Eve", wantErr: true},
+	}
+	for _, tt := range tests {
+		m, err := b.Lookup(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Lookup(%q) = %s, want error", tt.name, m.UserName)
+			}
+			continue
+		}
+		if err != nil || m.UserName != tt.want {
+			t.Errorf("Lookup(%q) = %v, %v, want %s", tt.name, m, err, tt.want)
+		}
+	}
+}
+
+func TestContactBookAddRemove(t *testing.T) {
+	b := NewContactBook([]*Member{
+		{UserName: "@a", NickName: "Alice"},
+		{UserName: "@@g", NickName: "Group"},
+	})
+	b.Add(&Member{UserName: "@a", NickName: "Alicia"})
+	if _, err := b.Lookup("Alice"); err == nil {
+		t.Errorf("Lookup(Alice) succeeded after rename")
+	}
+	if m, err := b.Lookup("Alicia"); err != nil || m.UserName != "@a" {
+		t.Errorf("Lookup(Alicia) = %v, %v", m, err)
+	}
+	if got := b.Members(ContactGroup); len(got) != 1 || got[0].UserName != "@@g" {
+		t.Errorf("Members(ContactGroup) = %v", got)
+	}
+	b.Remove("@a")
+	if b.Get("@a") != nil || b.Len() != 1 {
+		t.Errorf("@a still present after Remove")
+	}
+	if _, err := b.Lookup("Alicia"); err == nil {
+		t.Errorf("Lookup(Alicia) succeeded after Remove")
+	}
+}
+
+func TestGetContactsPaging(t *testing.T) {
+	pages := map[string]string{
+		"0":   `{"BaseResponse": {"Ret": 0}, "Seq": 123, "MemberList": [{"UserName": "@a", "NickName": "Alice"}]}`,
+		"123": `{"BaseResponse": {"Ret": 0}, "Seq": 0, "MemberList": [{"UserName": "@b", "NickName": "Bob"}]}`,
+	}
+	var seqs []string
+	c := funcClient(func(method, u string, body io.Reader) (*http.Response, error) {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := parsed.Query().Get("seq")
+		seqs = append(seqs, seq)
+		return newResponse(200, pages[seq]), nil
+	})
+	w := &Wechat{Client: c, host: "wx2.qq.com"}
+	b, err := w.GetContacts()
+	if err != nil {
+		t.Fatalf("GetContacts: %v", err)
+	}
+	if b.Len() != 2 || b.Get("@a") == nil || b.Get("@b") == nil {
+		t.Errorf("GetContacts = %v, want @a and @b", b.Members())
+	}
+	if want := []string{"0", "123"}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("seqs = %v, want %v", seqs, want)
+	}
+}
+
+func TestUpdateContacts(t *testing.T) {
+	w := &Wechat{}
+	w.contacts().Reset([]*Member{
+		{UserName: "@a", NickName: "Alice"},
+		{UserName: "@b", NickName: "Bob"},
+		{UserName: "@@g", NickName: "Group", MemberList: []*Member{{UserName: "@a"}}},
+	})
+	w.updateContacts(&BaseResponseJSON{
+		ModContactList: []*Member{
+			{UserName: "@a", NickName: "Alicia"},
+			{UserName: "@c", NickName: "Carol"},
+			{UserName: "@@g", NickName: "New Group"},
+		},
+		DelContactList: []*Member{{UserName: "@b"}},
+	})
+	if m, err := w.Contacts.Lookup("Alicia"); err != nil || m.UserName != "@a" {
+		t.Errorf("Lookup(Alicia) = %v, %v", m, err)
+	}
+	if w.Contacts.Get("@b") != nil {
+		t.Errorf("@b not deleted")
+	}
+	if w.Contacts.Get("@c") == nil {
+		t.Errorf("@c not added")
+	}
+	if g := w.Contacts.Get("@@g"); g.NickName != "New Group" || len(g.MemberList) != 1 {
+		t.Errorf("@@g = %+v, want renamed with members kept", g)
+	}
+}
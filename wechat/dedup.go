@@ -0,0 +1,153 @@
+package wechat
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Defaults of Dedup.
+const (
+	defaultDedupSize = 5000
+	defaultDedupTTL  = 24 * time.Hour
+)
+
+// Dedup remembers the recently seen message IDs, up to MaxSize of them for
+// up to TTL each. It is safe for concurrent use.
+type Dedup struct {
+	// MaxSize defaults to 5000.
+	MaxSize int
+	// TTL defaults to 24h.
+	TTL time.Duration
+
+	mu sync.Mutex
+	// order has the *dedupEntry values, least recently seen first.
+	order *list.List
+	index map[string]*list.Element
+	now   func() time.Time
+}
+
+// dedupEntry is a seen message ID. It is persisted with the session.
+type dedupEntry struct {
+	ID   string    `json:"ID"`
+	Seen time.Time `json:"Seen"`
+}
+
+// NewDedup returns a Dedup with the given bounds. Zero values mean the
+// defaults.
+func NewDedup(maxSize int, ttl time.Duration) *Dedup {
+	return &Dedup{MaxSize: maxSize, TTL: ttl}
+}
+
+func (d *Dedup) init() {
+	if d.order == nil {
+		d.order = list.New()
+		d.index = make(map[string]*list.Element)
+	}
+	if d.now == nil {
+		d.now = time.Now
+	}
+}
+
+// Seen records id and returns whether it was seen before.
+func (d *Dedup) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	now := d.now()
+	d.expire(now)
+	if e, ok := d.index[id]; ok {
+		e.Value.(*dedupEntry).Seen = now
+		d.order.MoveToBack(e)
+		return true
+	}
+	d.add(&dedupEntry{ID: id, Seen: now})
+	return false
+}
+
+// Len returns the number of remembered IDs.
+func (d *Dedup) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	d.expire(d.now())
+	return d.order.Len()
+}
+
+func (d *Dedup) add(e *dedupEntry) {
+	d.index[e.ID] = d.order.PushBack(e)
+	max := d.MaxSize
+	if max <= 0 {
+		max = defaultDedupSize
+	}
+	for d.order.Len() > max {
+		d.remove(d.order.Front())
+	}
+}
+
+func (d *Dedup) remove(e *list.Element) {
+	delete(d.index, e.Value.(*dedupEntry).ID)
+	d.order.Remove(e)
+}
+
+// expire forgets the IDs older than TTL.
+func (d *Dedup) expire(now time.Time) {
+	ttl := d.TTL
+	if ttl <= 0 {
+		ttl = defaultDedupTTL
+	}
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(*dedupEntry).Seen) >= ttl; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+// entries returns the remembered IDs, least recently seen first.
+func (d *Dedup) entries() []*dedupEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	d.expire(d.now())
+	var res []*dedupEntry
+	for e := d.order.Front(); e != nil; e = e.Next() {
+		entry := *e.Value.(*dedupEntry)
+		res = append(res, &entry)
+	}
+	return res
+}
+
+// restore adds the given entries, least recently seen first.
+func (d *Dedup) restore(entries []*dedupEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.init()
+	for _, e := range entries {
+		if old, ok := d.index[e.ID]; ok {
+			d.remove(old)
+		}
+		d.add(e)
+	}
+	d.expire(d.now())
+}
+
+// dedup returns w.Dedup, creating it if needed.
+func (w *Wechat) dedup() *Dedup {
+	w.contactsMu.Lock()
+	defer w.contactsMu.Unlock()
+	if w.Dedup == nil {
+		w.Dedup = NewDedup(0, 0)
+	}
+	return w.Dedup
+}
+
+// dropSeen removes the messages seen before from msgs.
+func (w *Wechat) dropSeen(msgs []*AddMsg) []*AddMsg {
+	d := w.dedup()
+	var res []*AddMsg
+	for _, msg := range msgs {
+		if msg.MsgID != "" && d.Seen(msg.MsgID) {
+			continue
+		}
+		res = append(res, msg)
+	}
+	return res
+}
@@ -0,0 +1,73 @@
+package wechat
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := NewDedup(2, time.Hour)
+	d.now = func() time.Time { return now }
+	if d.Seen("1") || d.Seen("2") {
+		t.Errorf("new IDs reported as seen")
+	}
+	if !d.Seen("1") {
+		t.Errorf("1 not seen")
+	}
+	// 2 is the least recently seen, so it goes.
+	d.Seen("3")
+	if d.Len() != 2 || d.Seen("2") {
+		t.Errorf("2 still remembered, Len = %d", d.Len())
+	}
+	now = now.Add(2 * time.Hour)
+	if d.Len() != 0 || d.Seen("1") {
+		t.Errorf("expired IDs still remembered")
+	}
+}
+
+func TestDedupPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.json")
+
+	sync := `{
+		"BaseResponse": {"Ret": 0},
+		"AddMsgList": [{"MsgId": "1", "MsgType": 1}, {"MsgId": "2", "MsgType": 1}],
+		"SyncCheckKey": {"Count": 1, "List": [{"Key": 1, "Val": 2}]}
+	}`
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		return newResponse(200, sync), nil
+	})
+	w := &Wechat{
+		Client:      c,
+		SessionFile: file,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{},
+			SyncKey:     &SyncKey{},
+		},
+		host: "wx2.qq.com",
+	}
+	br, err := w.WebwxSync()
+	if err != nil || len(br.AddMsgList) != 2 {
+		t.Fatalf("WebwxSync = %v, %v, want 2 messages", br, err)
+	}
+
+	// A replay after resuming the session drops the messages.
+	w2 := &Wechat{Client: c, SessionFile: file}
+	if err := w2.loadSession(); err != nil {
+		t.Fatalf("loadSession failed: %v", err)
+	}
+	br, err = w2.WebwxSync()
+	if err != nil || len(br.AddMsgList) != 0 {
+		t.Errorf("WebwxSync after resume = %v, %v, want no messages", br, err)
+	}
+}
@@ -0,0 +1,99 @@
+package wechat
+
+import (
+	"net"
+	"strings"
+)
+
+// DefaultLoginHost is where logins start before the region of the account is
+// known.
+const DefaultLoginHost = "https://login.weixin.qq.com"
+
+// Endpoints are the URLs of the hosts serving an account.
+type Endpoints struct {
+	// Login serves the QR code and login polling.
+	Login string
+	// Web serves the API, e.g. webwxinit and webwxsendmsg.
+	Web string
+	// Push serves synccheck. The hosts are tried in order.
+	Push []string
+	// File serves media uploads and downloads.
+	File string
+}
+
+// region maps redirect hosts containing match to the hosts of their region.
+type region struct {
+	match string
+	base  string
+	// push is tried after webpush.<base>.
+	push []string
+}
+
+// regions are the domain rules of the web client. The first match wins, so
+// more specific domains come first.
+var regions = []*region{
+	{match: "wx2.qq.com", base: "wx2.qq.com"},
+	{match: "wx8.qq.com", base: "wx8.qq.com"},
+	{match: "qq.com", base: "wx.qq.com"},
+	{match: "web2.wechat.com", base: "web2.wechat.com"},
+	{match: "wechat.com", base: "web.wechat.com", push: []string{"webpush2.wechat.com", "webpush.wechat.com"}},
+}
+
+// EndpointsFor returns the endpoints for an account whose login redirected
+// to host, e.g. "wx2.qq.com". The login, push and file hosts are derived
+// with the domain rules of the web client, and unknown domains get
+// login.<host>, webpush.<host> and file.<host>. An IP address is used for
+// everything. An empty host gives DefaultLoginHost only.
+func EndpointsFor(host string) *Endpoints {
+	if host == "" {
+		return &Endpoints{Login: DefaultLoginHost}
+	}
+	e := &Endpoints{Web: "https://" + host}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	if net.ParseIP(name) != nil {
+		e.Login, e.Push, e.File = e.Web, []string{e.Web}, e.Web
+		return e
+	}
+	base := host
+	var push []string
+	for _, r := range regions {
+		if strings.Contains(name, r.match) {
+			base, push = r.base, r.push
+			break
+		}
+	}
+	e.Login = "https://login." + base
+	e.File = "https://file." + base
+	e.Push = []string{"https://webpush." + base}
+	for _, p := range push {
+		e.Push = append(e.Push, "https://"+p)
+	}
+	return e
+}
+
+// endpoints returns the endpoints derived from the current host, overridden
+// by the non-empty fields of w.Endpoints.
+func (w *Wechat) endpoints() *Endpoints {
+	w.sessionMu.RLock()
+	host := w.host
+	w.sessionMu.RUnlock()
+	e := EndpointsFor(host)
+	if o := w.Endpoints; o != nil {
+		if o.Login != "" {
+			e.Login = o.Login
+		}
+		if o.Web != "" {
+			e.Web = o.Web
+		}
+		if len(o.Push) > 0 {
+			e.Push = o.Push
+		}
+		if o.File != "" {
+			e.File = o.File
+		}
+	}
+	return e
+}
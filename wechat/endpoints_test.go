@@ -0,0 +1,74 @@
+package wechat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEndpointsFor(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		want *Endpoints
+	}{
+		{"", &Endpoints{Login: DefaultLoginHost}},
+		{"wx.qq.com", &Endpoints{
+			Login: "https://login.wx.qq.com",
+			Web:   "https://wx.qq.com",
+			Push:  []string{"https://webpush.wx.qq.com"},
+			File:  "https://file.wx.qq.com",
+		}},
+		{"wx2.qq.com", &Endpoints{
+			Login: "https://login.wx2.qq.com",
+			Web:   "https://wx2.qq.com",
+			Push:  []string{"https://webpush.wx2.qq.com"},
+			File:  "https://file.wx2.qq.com",
+		}},
+		{"wx8.qq.com", &Endpoints{
+			Login: "https://login.wx8.qq.com",
+			Web:   "https://wx8.qq.com",
+			Push:  []string{"https://webpush.wx8.qq.com"},
+			File:  "https://file.wx8.qq.com",
+		}},
+		{"web.wechat.com", &Endpoints{
+			Login: "https://login.web.wechat.com",
+			Web:   "https://web.wechat.com",
+			Push:  []string{"https://webpush.web.wechat.com", "https://webpush2.wechat.com", "https://webpush.wechat.com"},
+			File:  "https://file.web.wechat.com",
+		}},
+		{"web2.wechat.com", &Endpoints{
+			Login: "https://login.web2.wechat.com",
+			Web:   "https://web2.wechat.com",
+			Push:  []string{"https://webpush.web2.wechat.com"},
+			File:  "https://file.web2.wechat.com",
+		}},
+		{"example.com", &Endpoints{
+			Login: "https://login.example.com",
+			Web:   "https://example.com",
+			Push:  []string{"https://webpush.example.com"},
+			File:  "https://file.example.com",
+		}},
+		{"127.0.0.1:8080", &Endpoints{
+			Login: "https://127.0.0.1:8080",
+			Web:   "https://127.0.0.1:8080",
+			Push:  []string{"https://127.0.0.1:8080"},
+			File:  "https://127.0.0.1:8080",
+		}},
+	} {
+		if got := EndpointsFor(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EndpointsFor(%q) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointsOverride(t *testing.T) {
+	w := &Wechat{host: "wx8.qq.com", Endpoints: &Endpoints{Web: "http://localhost:8080"}}
+	want := &Endpoints{
+		Login: "https://login.wx8.qq.com",
+		Web:   "http://localhost:8080",
+		Push:  []string{"https://webpush.wx8.qq.com"},
+		File:  "https://file.wx8.qq.com",
+	}
+	if got := w.endpoints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors matched by APIError with errors.Is.
+var (
+	// ErrSessionExpired means the session is no longer valid (Ret 1101 or
+	// 1102, or synccheck retcode 1101 or 1102). Log in again.
+	// ErrLoginElsewhere and ErrSessionInvalid tell which.
+	ErrSessionExpired = errors.New("session expired")
+	// ErrRateLimited means the requests are too frequent (Ret 1205 or HTTP
+	// 429). Slow down.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// Known BaseResponse.Ret values.
+const (
+	retLoggedOut      = 1100
+	retSessionExpired = 1101
+	retSessionInvalid = 1102
+	retTooFrequent    = 1205
+)
+
+// APIError is a failed call to a WeChat endpoint. Use errors.Is with
+// ErrSessionExpired, ErrLoginElsewhere, ErrSessionInvalid, ErrLoggedOut or
+// ErrRateLimited to branch on the reason, or errors.As to get the details.
+type APIError struct {
+	// Endpoint is the name of the endpoint, e.g. "webwxsendmsg".
+	Endpoint string
+	// StatusCode is the HTTP status code.
+	StatusCode int
+	// Ret and ErrMsg come from the BaseResponse, if any.
+	Ret    int
+	ErrMsg string
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode != http.StatusOK {
+		return fmt.Sprintf("error on %s: HTTP status: %d %s", e.Endpoint, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("error on %s: Ret: %d, ErrMsg: %q", e.Endpoint, e.Ret, e.ErrMsg)
+}
+
+// Is reports whether e matches one of the sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrSessionExpired:
+		return e.Ret == retSessionExpired || e.Ret == retSessionInvalid
+	case ErrLoginElsewhere:
+		return e.Ret == retSessionExpired
+	case ErrSessionInvalid:
+		return e.Ret == retSessionInvalid
+	case ErrLoggedOut:
+		return e.Ret == retLoggedOut
+	case ErrRateLimited:
+		return e.Ret == retTooFrequent || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// endpointName returns the endpoint name of a URL path like
+// "webwxsendmsg?fun=async&f=json".
+func endpointName(endpoint string) string {
+	if i := strings.IndexAny(endpoint, "?&"); i >= 0 {
+		endpoint = endpoint[:i]
+	}
+	return endpoint
+}
+
+// statusError returns the error for a response with an unexpected status.
+func statusError(endpoint string, resp *http.Response) error {
+	return &APIError{Endpoint: endpointName(endpoint), StatusCode: resp.StatusCode}
+}
+
+// retError returns the error for a BaseResponse with a non-zero Ret.
+func retError(endpoint string, br *BaseResponse) error {
+	return &APIError{Endpoint: endpointName(endpoint), StatusCode: http.StatusOK, Ret: br.Ret, ErrMsg: br.ErrMsg}
+}
@@ -0,0 +1,151 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+// The event types.
+const (
+	// MessageEvent carries a new message in Event.Msg.
+	MessageEvent EventType = iota
+	// ContactEvent carries modified and deleted contacts in
+	// Event.ModContacts and Event.DelContacts. They are already applied to
+	// Wechat.Contacts.
+	ContactEvent
+	// LogoutEvent means the session ended. Event.SyncRes has the retcode
+	// and Event.Err tells why, e.g. ErrLoginElsewhere. Unless
+	// Wechat.AutoRelogin is set, it is the last event sent by Run.
+	LogoutEvent
+	// ErrorEvent carries a transient error in Event.Err, e.g. an unknown
+	// synccheck retcode. Run keeps going.
+	ErrorEvent
+	// ReloginEvent means Run logged in again after a LogoutEvent.
+	ReloginEvent
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MessageEvent:
+		return "message"
+	case ContactEvent:
+		return "contact"
+	case LogoutEvent:
+		return "logout"
+	case ErrorEvent:
+		return "error"
+	case ReloginEvent:
+		return "relogin"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is something that happened to the logged in account.
+type Event struct {
+	Type        EventType
+	Msg         *AddMsg
+	ModContacts []*Member
+	DelContacts []*Member
+	SyncRes     *SyncRes
+	Err         error
+}
+
+// errorBackoff is how long Run waits after an error before syncing again.
+const errorBackoff = time.Second
+
+// Run syncs with the server until ctx is done or the session ends, sending
+// what happens to events. The SyncKey is kept up to date, so callers only
+// deal with events. Run returns ctx.Err() or an error describing the logout,
+// which wraps ErrLoggedOut, ErrLoginElsewhere or ErrSessionInvalid if known.
+func (w *Wechat) Run(ctx context.Context, events chan<- *Event) error {
+	send := func(e *Event) error {
+		select {
+		case events <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		sr, err := w.SyncCheckContext(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if err := send(&Event{Type: ErrorEvent, Err: fmt.Errorf("error on SyncCheck: %v", err)}); err != nil {
+				return err
+			}
+			if err := sleep(ctx, errorBackoff); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sr.Retcode.Err(); err != nil {
+			// Only the known retcodes end the session.
+			if errors.Is(err, errUnknownRetcode) {
+				if e := send(&Event{Type: ErrorEvent, SyncRes: sr, Err: fmt.Errorf("error on SyncCheck: %w", err)}); e != nil {
+					return e
+				}
+				if e := sleep(ctx, errorBackoff); e != nil {
+					return e
+				}
+				continue
+			}
+			if e := send(&Event{Type: LogoutEvent, SyncRes: sr, Err: err}); e != nil {
+				return e
+			}
+			if !w.AutoRelogin {
+				return err
+			}
+			glog.Warningf("Session ended: %v. Logging in again", err)
+			if rerr := w.ReloginContext(ctx); rerr != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("%w, and failed to log in again: %v", err, rerr)
+			}
+			if err := send(&Event{Type: ReloginEvent}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !sr.Selector.NeedsSync() {
+			continue
+		}
+		if !sr.Selector.Known() {
+			glog.Warningf("Unknown selector %s, syncing anyway", sr.Selector)
+		}
+		br, err := w.WebwxSyncContext(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if err := send(&Event{Type: ErrorEvent, Err: fmt.Errorf("error on WebwxSync: %v", err)}); err != nil {
+				return err
+			}
+			if err := sleep(ctx, errorBackoff); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(br.ModContactList) > 0 || len(br.DelContactList) > 0 {
+			glog.Infof("Got %d modified and %d deleted contacts", len(br.ModContactList), len(br.DelContactList))
+			e := &Event{Type: ContactEvent, ModContacts: br.ModContactList, DelContacts: br.DelContactList}
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+		for _, msg := range br.AddMsgList {
+			if err := send(&Event{Type: MessageEvent, Msg: msg}); err != nil {
+				return err
+			}
+		}
+	}
+}
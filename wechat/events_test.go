@@ -0,0 +1,197 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	checks := []string{
+		`window.synccheck={retcode:"0",selector:"0"}`,
+		`window.synccheck={retcode:"0",selector:"2"}`,
+		`window.synccheck={retcode:"1205",selector:"0"}`,
+		`window.synccheck={retcode:"1101",selector:"0"}`,
+	}
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		switch {
+		case strings.Contains(url, "/synccheck?"):
+			// The last one repeats, as SyncCheck retries on errors.
+			check := checks[0]
+			if len(checks) > 1 {
+				checks = checks[1:]
+			}
+			return newResponse(200, check), nil
+		case strings.Contains(url, "/webwxsync?"):
+			return newResponse(200, `{
+				"BaseResponse": {"Ret": 0},
+				"AddMsgList": [{"MsgId": "1", "MsgType": 1, "Content": "hi", "FromUserName": "@a"}],
+				"ModContactList": [{"UserName": "@b", "NickName": "b"}],
+				"SyncCheckKey": {"Count": 1, "List": [{"Key": 1, "Val": 2}]}
+			}`), nil
+		}
+		t.Fatalf("unexpected request: %s %s", method, url)
+		return nil, nil
+	})
+	w := &Wechat{
+		Client: c,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{},
+			SyncKey:     &SyncKey{},
+		},
+		host: "wx2.qq.com",
+	}
+	events := make(chan *Event, 10)
+	if err := w.Run(context.Background(), events); !errors.Is(err, ErrLoginElsewhere) {
+		t.Errorf("Run = %v, want %v", err, ErrLoginElsewhere)
+	}
+	close(events)
+	var types []EventType
+	for e := range events {
+		types = append(types, e.Type)
+	}
+	want := []EventType{ContactEvent, MessageEvent, ErrorEvent, LogoutEvent}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	if got := w.baseRequestJSON.SyncKey.String(); got != "1_2" {
+		t.Errorf("SyncKey = %s, want %s", got, "1_2")
+	}
+}
+
+func TestRunRelogin(t *testing.T) {
+	var mu sync.Mutex
+	loggedIn := false
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(url, "/synccheck?"):
+			if !loggedIn {
+				return newResponse(200, `window.synccheck={retcode:"1100",selector:"0"}`), nil
+			}
+			return newResponse(200, `window.synccheck={retcode:"0",selector:"0"}`), nil
+		case strings.Contains(url, "/webwxpushloginurl?uin=123"):
+			return newResponse(200, `{"ret": "0", "msg": "all ok", "uuid": "u"}`), nil
+		case strings.Contains(url, "/login?"):
+			return newResponse(200, "window.code=200;\nwindow.redirect_uri=\"https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=t\";"), nil
+		case strings.Contains(url, "/webwxnewloginpage?"):
+			return newResponse(301, `<error><ret>0</ret><skey>s</skey><wxsid>sid</wxsid><wxuin>123</wxuin><pass_ticket>p</pass_ticket></error>`), nil
+		case strings.Contains(url, "/webwxinit?"):
+			loggedIn = true
+			return newResponse(200, `{"BaseResponse": {"Ret": 0}, "User": {"UserName": "@me"}, "SyncKey": {"Count": 0}}`), nil
+		case strings.Contains(url, "/webwxgetcontact?"):
+			return newResponse(200, `{"BaseResponse": {"Ret": 0}, "MemberList": [{"UserName": "@a"}]}`), nil
+		}
+		t.Errorf("unexpected request: %s %s", method, url)
+		return newResponse(404, ""), nil
+	})
+	w := &Wechat{
+		Client: c,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{Uin: "123"},
+			SyncKey:     &SyncKey{},
+		},
+		QRPresenter: nopPresenter{},
+		AutoRelogin: true,
+		host:        "wx2.qq.com",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *Event)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- w.Run(ctx, events)
+	}()
+	var types []EventType
+	for e := range events {
+		types = append(types, e.Type)
+		if e.Type == ReloginEvent {
+			break
+		}
+	}
+	cancel()
+	if err := <-runErr; err != context.Canceled {
+		t.Errorf("Run = %v, want %v", err, context.Canceled)
+	}
+	if want := []EventType{LogoutEvent, ReloginEvent}; !reflect.DeepEqual(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	if w.user == nil || w.user.UserName != "@me" || w.Contacts.Get("@a") == nil {
+		t.Errorf("User = %+v, contacts = %v after relogin", w.user, w.Contacts.Members())
+	}
+}
+
+func TestRunSyncErrorBackoff(t *testing.T) {
+	var mu sync.Mutex
+	syncs := 0
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		if strings.Contains(url, "/synccheck?") {
+			return newResponse(200, `window.synccheck={retcode:"0",selector:"2"}`), nil
+		}
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+		return newResponse(500, ""), nil
+	})
+	w := &Wechat{
+		Client: c,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{},
+			SyncKey:     &SyncKey{},
+		},
+		RetryPolicy: &RetryPolicy{MaxAttempts: 1},
+		host:        "wx2.qq.com",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), errorBackoff/2)
+	defer cancel()
+	events := make(chan *Event, 100)
+	if err := w.Run(ctx, events); err != context.DeadlineExceeded {
+		t.Errorf("Run = %v, want %v", err, context.DeadlineExceeded)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if syncs != 1 {
+		t.Errorf("got %d webwxsync requests, want 1 before the backoff ends", syncs)
+	}
+}
+
+func TestRetcodeErr(t *testing.T) {
+	for _, tt := range []struct {
+		r    Retcode
+		want error
+	}{
+		{RetcodeOK, nil},
+		{RetcodeLoggedOut, ErrLoggedOut},
+		{RetcodeLoginElsewhere, ErrLoginElsewhere},
+		{RetcodeSessionInvalid, ErrSessionInvalid},
+	} {
+		if err := tt.r.Err(); err != tt.want {
+			t.Errorf("Retcode(%s).Err() = %v, want %v", tt.r, err, tt.want)
+		}
+	}
+	// synccheck and the API agree on ErrSessionExpired and ErrLoggedOut.
+	for _, tt := range []struct {
+		r      Retcode
+		target error
+		want   bool
+	}{
+		{RetcodeLoginElsewhere, ErrSessionExpired, true},
+		{RetcodeSessionInvalid, ErrSessionExpired, true},
+		{RetcodeLoggedOut, ErrSessionExpired, false},
+		{RetcodeLoggedOut, ErrLoggedOut, true},
+	} {
+		if got := errors.Is(fmt.Errorf("session ended: %w", tt.r.Err()), tt.target); got != tt.want {
+			t.Errorf("errors.Is(Retcode(%s).Err(), %v) = %v, want %v", tt.r, tt.target, got, tt.want)
+		}
+	}
+	if err := Retcode("1205").Err(); err == nil {
+		t.Errorf("Retcode(1205).Err() = nil, want error")
+	}
+}
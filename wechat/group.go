@@ -0,0 +1,222 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// mentionSep is what the WeChat clients put after an @-mention.
+const mentionSep = "\u2005"
+
+// batchGetContactLimit is the max number of contacts per webwxbatchgetcontact.
+const batchGetContactLimit = 50
+
+type batchContact struct {
+	UserName        string `json:"UserName"`
+	EncryChatRoomID string `json:"EncryChatRoomId"`
+}
+
+type batchGetContactRequest struct {
+	BaseRequest *BaseRequest    `json:"BaseRequest"`
+	Count       int             `json:"Count"`
+	List        []*batchContact `json:"List"`
+}
+
+// BatchGetContact retrieves the given contacts. Groups come with their
+// member lists.
+func (w *Wechat) BatchGetContact(userNames []string) ([]*Member, error) {
+	return w.BatchGetContactContext(context.Background(), userNames)
+}
+
+// BatchGetContactContext is like BatchGetContact but gives up when ctx is
+// done.
+func (w *Wechat) BatchGetContactContext(ctx context.Context, userNames []string) ([]*Member, error) {
+	var res []*Member
+	for len(userNames) > 0 {
+		n := len(userNames)
+		if n > batchGetContactLimit {
+			n = batchGetContactLimit
+		}
+		var members []*Member
+		err := w.retry(ctx, "BatchGetContact", func() error {
+			var err error
+			members, err = w.batchGetContactHelper(ctx, userNames[:n])
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, members...)
+		userNames = userNames[n:]
+	}
+	return res, nil
+}
+
+func (w *Wechat) batchGetContactHelper(ctx context.Context, userNames []string) ([]*Member, error) {
+	req := &batchGetContactRequest{
+		BaseRequest: w.baseRequest(),
+		Count:       len(userNames),
+	}
+	for _, u := range userNames {
+		req.List = append(req.List, &batchContact{UserName: u})
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal: %v", err)
+	}
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxbatchgetcontact?type=ex&r=%d&pass_ticket=%s",
+		w.endpoints().Web, NowUnixMilli(), w.passTicket())
+	resp, err := w.do(ctx, "POST", url, bytes.NewBuffer(b))
+	if err != nil {
+		return nil, fmt.Errorf("error on POST: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, statusError("webwxbatchgetcontact", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %v", err)
+	}
+	glog.V(1).Infof("BatchGetContact: %s", string(body))
+	br := &BaseResponseJSON{}
+	if err := json.Unmarshal(body, br); err != nil {
+		return nil, fmt.Errorf("error on unmarshal: %v", err)
+	}
+	if br.BaseResponse == nil {
+		return nil, fmt.Errorf("no BaseResponse: %s", string(body))
+	}
+	if br.BaseResponse.Ret != 0 {
+		return nil, retError("webwxbatchgetcontact", br.BaseResponse)
+	}
+	return br.ContactList, nil
+}
+
+// attribute fills in who sent each message. For group messages, it strips
+// the "sender:<br/>" prefix from Content and fetches the group members if
+// the sender is not known yet.
+func (w *Wechat) attribute(ctx context.Context, msgs []*AddMsg) {
+	me := w.CurrentUser()
+	fetched := make(map[string]bool)
+	for _, msg := range msgs {
+		msg.SenderUserName = msg.FromUserName
+		groupName := msg.FromUserName
+		if !strings.HasPrefix(groupName, "@@") {
+			// Messages we sent to a group from another device.
+			groupName = msg.ToUserName
+		}
+		if !strings.HasPrefix(groupName, "@@") {
+			if n := w.contacts().Get(msg.FromUserName); n != nil {
+				msg.NickName = n.NickName
+			} else {
+				msg.NickName = msg.FromUserName
+			}
+			continue
+		}
+		if groupName == msg.FromUserName {
+			for _, sep := range []string{":<br/>", ":\n"} {
+				if i := strings.Index(msg.Content, sep); i > 0 && strings.HasPrefix(msg.Content, "@") {
+					msg.SenderUserName = msg.Content[:i]
+					msg.Content = msg.Content[i+len(sep):]
+					break
+				}
+			}
+		}
+		group := w.contacts().Get(groupName)
+		var sender *Member
+		if group != nil {
+			sender = group.GroupMember(msg.SenderUserName)
+		}
+		if sender == nil && !fetched[groupName] {
+			fetched[groupName] = true
+			if g := w.fetchGroup(ctx, groupName); g != nil {
+				group = g
+				sender = group.GroupMember(msg.SenderUserName)
+			}
+		}
+		if group != nil {
+			msg.GroupNickName = group.NickName
+		} else {
+			msg.GroupNickName = groupName
+		}
+		switch {
+		case sender != nil:
+			msg.NickName = sender.Name()
+		case me != nil && msg.SenderUserName == me.UserName:
+			msg.NickName = me.NickName
+		default:
+			msg.NickName = msg.SenderUserName
+		}
+		msg.MentionedMe = mentions(me, group, msg.Content)
+	}
+}
+
+// fetchGroup retrieves the group with its members and saves it to
+// w.Contacts.
+func (w *Wechat) fetchGroup(ctx context.Context, userName string) *Member {
+	glog.Infof("Getting members of group %s", userName)
+	groups, err := w.BatchGetContactContext(ctx, []string{userName})
+	if err != nil || len(groups) != 1 {
+		glog.Warningf("Failed to get group %s: %v", userName, err)
+		return nil
+	}
+	w.contacts().Add(groups[0])
+	return groups[0]
+}
+
+// mentions returns whether content of a message in group mentions user.
+func mentions(user, group *Member, content string) bool {
+	if user == nil {
+		return false
+	}
+	names := []string{user.NickName}
+	if group != nil {
+		if m := group.GroupMember(user.UserName); m != nil && m.DisplayName != "" {
+			names = append(names, m.DisplayName)
+		}
+	}
+	content = unescapeContent(content)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		at := "@" + name
+		if strings.Contains(content, at+mentionSep) || strings.Contains(content, at+" ") || strings.HasSuffix(content, at) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendMentionMsg sends text to the group, @-mentioning the given members.
+func (w *Wechat) SendMentionMsg(groupUserName, text string, userNames ...string) error {
+	return w.SendMentionMsgContext(context.Background(), groupUserName, text, userNames...)
+}
+
+// SendMentionMsgContext is like SendMentionMsg but gives up when ctx is done.
+func (w *Wechat) SendMentionMsgContext(ctx context.Context, groupUserName, text string, userNames ...string) error {
+	group := w.contacts().Get(groupUserName)
+	if group == nil || len(group.MemberList) == 0 {
+		group = w.fetchGroup(ctx, groupUserName)
+	}
+	if group == nil {
+		return fmt.Errorf("unknown group: %s", groupUserName)
+	}
+	var b strings.Builder
+	for _, u := range userNames {
+		member := group.GroupMember(u)
+		if member == nil {
+			return fmt.Errorf("%s is not a member of %s", u, group.NickName)
+		}
+		b.WriteString("@" + member.Name() + mentionSep)
+	}
+	b.WriteString(text)
+	return w.SendMsgContext(ctx, &Msg{Type: MsgTypeText, Content: b.String(), ToUserName: groupUserName})
+}
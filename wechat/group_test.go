@@ -0,0 +1,90 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAttributeGroupMessage(t *testing.T) {
+	batches := 0
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		if !strings.Contains(url, "/webwxbatchgetcontact?") {
+			t.Fatalf("unexpected request: %s %s", method, url)
+		}
+		batches++
+		b, _ := ioutil.ReadAll(body)
+		req := &batchGetContactRequest{}
+		if err := json.Unmarshal(b, req); err != nil || len(req.List) != 1 || req.List[0].UserName != "@@g" {
+			t.Errorf("got request %s", b)
+		}
+		return newResponse(200, `{
+			"BaseResponse": {"Ret": 0},
+			"ContactList": [{
+				"UserName": "@@g",
+				"NickName": "Group",
+				"MemberList": [
+					{"UserName": "@a", "NickName": "Alice", "DisplayName": "Al"},
+					{"UserName": "@me", "NickName": "Me"}
+				]
+			}]
+		}`), nil
+	})
+	w := &Wechat{
+		Client:          c,
+		baseRequestJSON: &BaseRequestJSON{BaseRequest: &BaseRequest{}},
+		user:            &Member{UserName: "@me", NickName: "Me"},
+		host:            "wx2.qq.com",
+	}
+	msgs := []*AddMsg{
+		{FromUserName: "@@g", ToUserName: "@me", MsgType: MsgTypeText, Content: "@a:<br/>hi @Me there"},
+		{FromUserName: "@@g", ToUserName: "@me", MsgType: MsgTypeText, Content: "@a:<br/>bye"},
+		{FromUserName: "@b", ToUserName: "@me", MsgType: MsgTypeText, Content: "hello"},
+	}
+	w.attribute(context.Background(), msgs)
+	if batches != 1 {
+		t.Errorf("got %d batchgetcontact calls, want 1", batches)
+	}
+	m := msgs[0]
+	if m.SenderUserName != "@a" || m.NickName != "Al" || m.GroupNickName != "Group" || m.Content != "hi @Me there" || !m.MentionedMe {
+		t.Errorf("got %+v", m)
+	}
+	if m := msgs[1]; m.NickName != "Al" || m.MentionedMe {
+		t.Errorf("got %+v", m)
+	}
+	if m := msgs[2]; m.NickName != "@b" || m.GroupNickName != "" {
+		t.Errorf("got %+v", m)
+	}
+	if g := w.Contacts.Get("@@g"); g == nil || len(g.MemberList) != 2 {
+		t.Errorf("group not saved: %+v", g)
+	}
+}
+
+func TestSendMentionMsg(t *testing.T) {
+	var sent *BaseRequestJSON
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		sent = &BaseRequestJSON{}
+		json.NewDecoder(body).Decode(sent)
+		return newResponse(200, `{"BaseResponse": {"Ret": 0}}`), nil
+	})
+	w := &Wechat{
+		Client:          c,
+		baseRequestJSON: &BaseRequestJSON{BaseRequest: &BaseRequest{}},
+		user:            &Member{UserName: "@me"},
+		host:            "wx2.qq.com",
+	}
+	w.contacts().Add(&Member{UserName: "@@g", MemberList: []*Member{{UserName: "@a", NickName: "Alice"}}})
+	if err := w.SendMentionMsg("@@g", "look", "@a"); err != nil {
+		t.Fatalf("SendMentionMsg failed: %v", err)
+	}
+	if want := "@Alice look"; sent.Msg.Content != want {
+		t.Errorf("Content = %q, want %q", sent.Msg.Content, want)
+	}
+	if err := w.SendMentionMsg("@@g", "look", "@x"); err == nil {
+		t.Errorf("SendMentionMsg to a non-member succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// LoginState is a state of the QR code login.
+type LoginState int
+
+// The login states. The codes in the comments are the window.code values
+// returned by the login endpoint.
+const (
+	// LoginWaiting means a QR code is shown and nobody has scanned it yet.
+	LoginWaiting LoginState = iota
+	// LoginScanned means the QR code is scanned but not confirmed (201).
+	LoginScanned
+	// LoginTimeout means a poll timed out without any change (408).
+	LoginTimeout
+	// LoginExpired means the QR code expired (400). A new one follows.
+	LoginExpired
+	// LoginConfirmed means the login is confirmed on the phone (200).
+	LoginConfirmed
+)
+
+func (s LoginState) String() string {
+	switch s {
+	case LoginWaiting:
+		return "waiting"
+	case LoginScanned:
+		return "scanned"
+	case LoginTimeout:
+		return "timeout"
+	case LoginExpired:
+		return "expired"
+	case LoginConfirmed:
+		return "confirmed"
+	}
+	return fmt.Sprintf("LoginState(%d)", int(s))
+}
+
+// LoginEvent reports a login state transition.
+type LoginEvent struct {
+	State LoginState
+	UUID  string
+	// Avatar is the data URI of the scanner's avatar. Set on LoginScanned.
+	Avatar string
+	// RedirectURI is the init URL. Set on LoginConfirmed.
+	RedirectURI string
+}
+
+// errQRExpired is returned by waitUntilLoggedIn when the QR code expired.
+var errQRExpired = errors.New("QR code expired")
+
+var (
+	loginCodeRe   = regexp.MustCompile(`window.code=(\d+);`)
+	loginAvatarRe = regexp.MustCompile(`window.userAvatar = '([^']*)'`)
+	redirectURIRe = regexp.MustCompile("window.redirect_uri=\"([^\"]+)\"")
+)
+
+// notifyLogin reports e to w.OnLoginEvent.
+func (w *Wechat) notifyLogin(e *LoginEvent) {
+	glog.Infof("Login state: %s", e.State)
+	if w.OnLoginEvent != nil {
+		w.OnLoginEvent(e)
+	}
+}
+
+// scanQRCode shows QR codes until one of them is scanned and confirmed,
+// fetching a new one whenever the previous one expires. Returns a
+// redirect_uri.
+func (w *Wechat) scanQRCode(ctx context.Context) (string, error) {
+	p := w.QRPresenter
+	if p == nil {
+		p = &FilePresenter{Path: "QR.jpg"}
+	}
+	for n := 1; ; n++ {
+		glog.Infof("Getting UUID...")
+		uuid, err := w.getUUID(ctx)
+		if err != nil {
+			return "", fmt.Errorf("error on getUUID(): %v", err)
+		}
+		glog.Infof("UUID: %s", uuid)
+
+		glog.Infof("Getting QR code...")
+		img, err := w.getQRCode(ctx, uuid)
+		if err != nil {
+			return "", fmt.Errorf("error on getting QR code: %v", err)
+		}
+		// The phone only confirms the canonical URL, which is what the QR
+		// code of the server encodes, whatever host served it.
+		if err := p.Present(loginURL(DefaultLoginHost, uuid), img); err != nil {
+			return "", fmt.Errorf("error on presenting QR code: %v", err)
+		}
+		w.notifyLogin(&LoginEvent{State: LoginWaiting, UUID: uuid})
+		rurl, err := w.waitUntilLoggedIn(ctx, uuid)
+		if err == errQRExpired {
+			if w.MaxQRCodes > 0 && n >= w.MaxQRCodes {
+				return "", fmt.Errorf("none of %d QR codes was scanned", n)
+			}
+			continue
+		}
+		return rurl, err
+	}
+}
+
+// waitUntilLoggedIn waits until user confirms the login on the phone or the
+// QR code expires. Returns a redirect_uri.
+func (w *Wechat) waitUntilLoggedIn(ctx context.Context, uuid string) (string, error) {
+	tip := 1
+	state := LoginWaiting
+	for {
+		url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/login?loginicon=true&uuid=%s&tip=%d&_=%d",
+			w.endpoints().Login, uuid, tip, NowUnixMilli())
+		var body string
+		err := w.retry(ctx, "Polling login", func() error {
+			var err error
+			body, err = w.pollLogin(ctx, url)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error on polling login: %v", err)
+		}
+		tip = 0
+		glog.V(1).Infof("Body: %s", body)
+		e := &LoginEvent{UUID: uuid}
+		matches := loginCodeRe.FindStringSubmatch(body)
+		if len(matches) != 2 {
+			return "", fmt.Errorf("invalid body: %s", body)
+		}
+		code, _ := strconv.Atoi(matches[1])
+		switch code {
+		case 200:
+			matches := redirectURIRe.FindStringSubmatch(body)
+			if len(matches) != 2 {
+				return "", fmt.Errorf("invalid body: %s", body)
+			}
+			e.State = LoginConfirmed
+			e.RedirectURI = matches[1]
+			w.notifyLogin(e)
+			return e.RedirectURI, nil
+		case 201:
+			if matches := loginAvatarRe.FindStringSubmatch(body); len(matches) == 2 {
+				e.Avatar = matches[1]
+			}
+			e.State = LoginScanned
+		case 408:
+			e.State = LoginTimeout
+		case 400:
+			e.State = LoginExpired
+			w.notifyLogin(e)
+			return "", errQRExpired
+		default:
+			return "", fmt.Errorf("unexpected login code %d: %s", code, body)
+		}
+		if e.State != state {
+			state = e.State
+			w.notifyLogin(e)
+		}
+	}
+}
+
+func (w *Wechat) pollLogin(ctx context.Context, url string) (string, error) {
+	resp, err := w.do(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error on GET: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", statusError("login", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading body: %v", err)
+	}
+	return string(body), nil
+}
+
+// pushLoginResponse is the response of webwxpushloginurl.
+type pushLoginResponse struct {
+	Ret  string `json:"ret"`
+	Msg  string `json:"msg"`
+	UUID string `json:"uuid"`
+}
+
+// Relogin logs in again after the session ended. It first asks the phone to
+// confirm the login, which needs no QR code, and falls back to Login if that
+// fails.
+func (w *Wechat) Relogin() error {
+	return w.ReloginContext(context.Background())
+}
+
+// ReloginContext is like Relogin but gives up when ctx is done.
+func (w *Wechat) ReloginContext(ctx context.Context) error {
+	err := w.pushLogin(ctx)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	glog.Warningf("Unable to log in again from the phone: %v. Falling back to the QR code", err)
+	return w.LoginContext(ctx)
+}
+
+// pushLogin asks the phone of the last logged in user to confirm a new
+// login, and waits for it.
+func (w *Wechat) pushLogin(ctx context.Context) error {
+	br := w.baseRequest()
+	if br == nil || br.Uin == "" {
+		return errors.New("no previous login")
+	}
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxpushloginurl?uin=%s",
+		w.endpoints().Web, br.Uin)
+	body, err := w.pollLogin(ctx, url)
+	if err != nil {
+		return err
+	}
+	glog.V(1).Infof("webwxpushloginurl: %s", body)
+	pr := &pushLoginResponse{}
+	if err := json.Unmarshal([]byte(body), pr); err != nil {
+		return fmt.Errorf("error on unmarshal: %v", err)
+	}
+	if pr.Ret != "0" || pr.UUID == "" {
+		return fmt.Errorf("error on webwxpushloginurl: %s", body)
+	}
+	glog.Infof("Asked the phone to confirm the login")
+	w.notifyLogin(&LoginEvent{State: LoginWaiting, UUID: pr.UUID})
+	rurl, err := w.waitUntilLoggedIn(ctx, pr.UUID)
+	if err != nil {
+		return err
+	}
+	return w.finishLogin(ctx, rurl)
+}
@@ -0,0 +1,115 @@
+package wechat
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// funcClient is an HTTPClient backed by a function.
+type funcClient func(method, url string, body io.Reader) (*http.Response, error)
+
+func (f funcClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return f(method, url, body)
+}
+
+func newResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+type nopPresenter struct{}
+
+func (nopPresenter) Present(loginURL string, img []byte) error { return nil }
+
+// urlPresenter records the presented URLs.
+type urlPresenter []string
+
+func (p *urlPresenter) Present(loginURL string, img []byte) error {
+	*p = append(*p, loginURL)
+	return nil
+}
+
+func TestScanQRCode(t *testing.T) {
+	polls := []string{
+		`window.code=408;`,
+		`window.code=400;`,
+		`window.code=408;`,
+		`window.code=201;window.userAvatar = 'data:img/jpg;base64,xyz';`,
+		`window.code=201;window.userAvatar = 'data:img/jpg;base64,xyz';`,
+		"window.code=200;\nwindow.redirect_uri=\"https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=t\";",
+	}
+	uuids := 0
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		switch {
+		case strings.Contains(url, "/jslogin"):
+			uuids++
+			return newResponse(200, `window.QRLogin.code = 200; window.QRLogin.uuid = "uuid=="`), nil
+		case strings.Contains(url, "/qrcode/"):
+			return newResponse(200, "jpg"), nil
+		case strings.Contains(url, "/login?"):
+			p := polls[0]
+			polls = polls[1:]
+			return newResponse(200, p), nil
+		}
+		t.Fatalf("unexpected request: %s %s", method, url)
+		return nil, nil
+	})
+	var states []LoginState
+	var avatar string
+	urls := &urlPresenter{}
+	w := &Wechat{
+		Client:      c,
+		QRPresenter: urls,
+		Endpoints:   &Endpoints{Login: "https://login.wx2.qq.com"},
+		OnLoginEvent: func(e *LoginEvent) {
+			states = append(states, e.State)
+			if e.State == LoginScanned {
+				avatar = e.Avatar
+			}
+		},
+	}
+	rurl, err := w.scanQRCode(context.Background())
+	if err != nil {
+		t.Fatalf("scanQRCode failed: %v", err)
+	}
+	if want := "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=t"; rurl != want {
+		t.Errorf("redirect_uri = %s, want %s", rurl, want)
+	}
+	if uuids != 2 {
+		t.Errorf("got %d UUIDs, want 2", uuids)
+	}
+	if want := "https://login.weixin.qq.com/l/uuid=="; len(*urls) != 2 || (*urls)[0] != want {
+		t.Errorf("presented %v, want %s", *urls, want)
+	}
+	want := []LoginState{LoginWaiting, LoginTimeout, LoginExpired, LoginWaiting, LoginTimeout, LoginScanned, LoginConfirmed}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+	if avatar != "data:img/jpg;base64,xyz" {
+		t.Errorf("avatar = %s, want %s", avatar, "data:img/jpg;base64,xyz")
+	}
+}
+
+func TestScanQRCodeMaxQRCodes(t *testing.T) {
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		switch {
+		case strings.Contains(url, "/jslogin"):
+			return newResponse(200, `window.QRLogin.uuid = "uuid=="`), nil
+		case strings.Contains(url, "/login?"):
+			return newResponse(200, `window.code=400;`), nil
+		}
+		return newResponse(200, ""), nil
+	})
+	w := &Wechat{Client: c, QRPresenter: nopPresenter{}, MaxQRCodes: 3}
+	if _, err := w.scanQRCode(context.Background()); err == nil {
+		t.Errorf("scanQRCode succeeded, want error")
+	}
+}
@@ -0,0 +1,116 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/golang/glog"
+)
+
+// download GETs rawurl of endpoint with header and copies the body to out.
+func (w *Wechat) download(ctx context.Context, endpoint, rawurl string, header http.Header, out io.Writer) error {
+	resp, err := w.doHeader(ctx, "GET", rawurl, header, nil)
+	if err != nil {
+		return fmt.Errorf("error on GET: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		return statusError(endpoint, resp)
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading body: %v", err)
+	}
+	glog.Infof("Downloaded %d bytes", n)
+	return nil
+}
+
+// skey returns the skey of the current login.
+func (w *Wechat) skey() string {
+	if br := w.baseRequest(); br != nil {
+		return br.Skey
+	}
+	return ""
+}
+
+// GetMsgImage writes the image of the given image message to out.
+func (w *Wechat) GetMsgImage(msgID string, out io.Writer) error {
+	return w.GetMsgImageContext(context.Background(), msgID, out)
+}
+
+// GetMsgImageContext is like GetMsgImage but gives up when ctx is done.
+func (w *Wechat) GetMsgImageContext(ctx context.Context, msgID string, out io.Writer) error {
+	u := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetmsgimg?MsgID=%s&skey=%s",
+		w.endpoints().Web, msgID, url.QueryEscape(w.skey()))
+	return w.download(ctx, "webwxgetmsgimg", u, nil, out)
+}
+
+// GetVoice writes the MP3 of the given voice message to out.
+func (w *Wechat) GetVoice(msgID string, out io.Writer) error {
+	return w.GetVoiceContext(context.Background(), msgID, out)
+}
+
+// GetVoiceContext is like GetVoice but gives up when ctx is done.
+func (w *Wechat) GetVoiceContext(ctx context.Context, msgID string, out io.Writer) error {
+	u := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetvoice?msgid=%s&skey=%s",
+		w.endpoints().Web, msgID, url.QueryEscape(w.skey()))
+	return w.download(ctx, "webwxgetvoice", u, nil, out)
+}
+
+// GetVideo writes the MP4 of the given video message to out.
+func (w *Wechat) GetVideo(msgID string, out io.Writer) error {
+	return w.GetVideoContext(context.Background(), msgID, out)
+}
+
+// GetVideoContext is like GetVideo but gives up when ctx is done.
+func (w *Wechat) GetVideoContext(ctx context.Context, msgID string, out io.Writer) error {
+	u := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetvideo?msgid=%s&skey=%s",
+		w.endpoints().Web, msgID, url.QueryEscape(w.skey()))
+	// The server returns nothing without a Range header.
+	return w.download(ctx, "webwxgetvideo", u, http.Header{"Range": {"bytes=0-"}}, out)
+}
+
+// GetMedia writes the attachment of the given file message to out.
+func (w *Wechat) GetMedia(msg *AddMsg, out io.Writer) error {
+	return w.GetMediaContext(context.Background(), msg, out)
+}
+
+// GetMediaContext is like GetMedia but gives up when ctx is done.
+func (w *Wechat) GetMediaContext(ctx context.Context, msg *AddMsg, out io.Writer) error {
+	host := w.endpoints().File
+	var uin string
+	if br := w.baseRequest(); br != nil {
+		uin = br.Uin
+	}
+	v := url.Values{}
+	v.Set("sender", msg.FromUserName)
+	v.Set("mediaid", msg.MediaID)
+	v.Set("encryfilename", msg.EncryFileName)
+	v.Set("fromuser", uin)
+	v.Set("pass_ticket", w.passTicket())
+	v.Set("webwx_data_ticket", w.cookie(host, "webwx_data_ticket"))
+	u := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetmedia?%s", host, v.Encode())
+	return w.download(ctx, "webwxgetmedia", u, nil, out)
+}
+
+// cookie returns the value of the named cookie sent to host, if the client
+// keeps cookies.
+func (w *Wechat) cookie(host, name string) string {
+	jar := clientJar(w.Client)
+	if jar == nil {
+		return ""
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// userClient is a ContextHTTPClient outside of the package, which only
+// sends the headers it is given.
+type userClient struct{}
+
+func (c userClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return c.DoContext(context.Background(), method, url, nil, body)
+}
+
+func (userClient) DoContext(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+func TestGetVideo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cgi-bin/mmwebwx-bin/webwxgetvideo" || r.URL.Query().Get("msgid") != "123" {
+			http.NotFound(rw, r)
+			return
+		}
+		if r.Header.Get("Range") != "bytes=0-" {
+			rw.WriteHeader(200)
+			return
+		}
+		rw.WriteHeader(206)
+		io.WriteString(rw, "video")
+	}))
+	defer srv.Close()
+	w := &Wechat{Client: NewClient(), Endpoints: &Endpoints{Web: srv.URL}}
+	var b bytes.Buffer
+	if err := w.GetVideoContext(context.Background(), "123", &b); err != nil {
+		t.Fatalf("GetVideo failed: %v", err)
+	}
+	if b.String() != "video" {
+		t.Errorf("got %q, want %q", b.String(), "video")
+	}
+	var e *APIError
+	if err := w.GetVideoContext(context.Background(), "404", &b); !errors.As(err, &e) || e.Endpoint != "webwxgetvideo" || e.StatusCode != 404 {
+		t.Errorf("GetVideo of a missing video returned %#v, want an APIError of webwxgetvideo", err)
+	}
+
+	// The Range header reaches the server through any ContextHTTPClient.
+	w.Client = userClient{}
+	b.Reset()
+	if err := w.GetVideoContext(context.Background(), "123", &b); err != nil || b.String() != "video" {
+		t.Errorf("GetVideo with another client = %q, %v, want %q", b.String(), err, "video")
+	}
+}
+
+func TestGetMedia(t *testing.T) {
+	var got url.Values
+	c := funcClient(func(method, u string, body io.Reader) (*http.Response, error) {
+		parsed, _ := url.Parse(u)
+		got = parsed.Query()
+		return newResponse(200, "file"), nil
+	})
+	w := &Wechat{
+		Client:    c,
+		loginInfo: &LoginInfo{PassTicket: "ticket"},
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{Uin: "42"},
+		},
+		host: "wx2.qq.com",
+	}
+	msg := &AddMsg{FromUserName: "@a", MediaID: "m", EncryFileName: "a%2Epdf"}
+	var b strings.Builder
+	if err := w.GetMedia(msg, &b); err != nil {
+		t.Fatalf("GetMedia failed: %v", err)
+	}
+	if b.String() != "file" {
+		t.Errorf("got %q, want %q", b.String(), "file")
+	}
+	for k, want := range map[string]string{"sender": "@a", "mediaid": "m", "encryfilename": "a%2Epdf", "fromuser": "42", "pass_ticket": "ticket"} {
+		if got.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, got.Get(k), want)
+		}
+	}
+}
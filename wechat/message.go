@@ -0,0 +1,278 @@
+package wechat
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Message types of AddMsg.MsgType.
+const (
+	MsgTypeText         = 1
+	MsgTypeImage        = 3
+	MsgTypeVoice        = 34
+	MsgTypeVerify       = 37
+	MsgTypeCard         = 42
+	MsgTypeVideo        = 43
+	MsgTypeEmoticon     = 47
+	MsgTypeLocation     = 48
+	MsgTypeApp          = 49
+	MsgTypeStatusNotify = 51
+	MsgTypeMicroVideo   = 62
+	MsgTypeSysNotice    = 9999
+	MsgTypeSys          = 10000
+	MsgTypeRecalled     = 10002
+)
+
+// App message types of AddMsg.AppMsgType.
+const (
+	AppMsgTypeText  = 1
+	AppMsgTypeImage = 2
+	AppMsgTypeAudio = 3
+	AppMsgTypeVideo = 4
+	AppMsgTypeURL   = 5
+	AppMsgTypeFile  = 6
+	AppMsgTypeGIF   = 8
+)
+
+// Message is an AddMsg decoded according to its type.
+type Message interface {
+	// Raw returns the message as received from the server.
+	Raw() *AddMsg
+	// String returns a human readable text of the message.
+	String() string
+}
+
+// TextMessage is a text message.
+type TextMessage struct {
+	*AddMsg
+	Text string
+}
+
+// Raw implements Message.
+func (m *TextMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *TextMessage) String() string { return m.Text }
+
+// ImageXML is the payload of an image message.
+type ImageXML struct {
+	AESKey       string `xml:"aeskey,attr"`
+	CDNThumbURL  string `xml:"cdnthumburl,attr"`
+	CDNMidImgURL string `xml:"cdnmidimgurl,attr"`
+	Length       int    `xml:"length,attr"`
+	MD5          string `xml:"md5,attr"`
+}
+
+// ImageMessage is an image message.
+type ImageMessage struct {
+	*AddMsg
+	Image ImageXML
+}
+
+// Raw implements Message.
+func (m *ImageMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *ImageMessage) String() string { return "[Image]" }
+
+// VoiceXML is the payload of a voice message.
+type VoiceXML struct {
+	Length       int    `xml:"length,attr"`
+	VoiceLength  int    `xml:"voicelength,attr"`
+	ClientMsgID  string `xml:"clientmsgid,attr"`
+	FromUserName string `xml:"fromusername,attr"`
+}
+
+// VoiceMessage is a voice message.
+type VoiceMessage struct {
+	*AddMsg
+	Voice VoiceXML
+}
+
+// Raw implements Message.
+func (m *VoiceMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *VoiceMessage) String() string {
+	return fmt.Sprintf("[Voice %ds]", (m.VoiceLength+999)/1000)
+}
+
+// VideoXML is the payload of a video message.
+type VideoXML struct {
+	AESKey      string `xml:"aeskey,attr"`
+	CDNThumbURL string `xml:"cdnthumburl,attr"`
+	Length      int    `xml:"length,attr"`
+	PlayLength  int    `xml:"playlength,attr"`
+	MD5         string `xml:"md5,attr"`
+}
+
+// VideoMessage is a video or micro video message.
+type VideoMessage struct {
+	*AddMsg
+	Video VideoXML
+}
+
+// Raw implements Message.
+func (m *VideoMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *VideoMessage) String() string {
+	return fmt.Sprintf("[Video %ds]", m.PlayLength)
+}
+
+// EmojiXML is the payload of an emoticon message.
+type EmojiXML struct {
+	MD5       string `xml:"md5,attr"`
+	Type      int    `xml:"type,attr"`
+	Len       int    `xml:"len,attr"`
+	ProductID string `xml:"productid,attr"`
+	CDNURL    string `xml:"cdnurl,attr"`
+	ThumbURL  string `xml:"thumburl,attr"`
+	Width     int    `xml:"width,attr"`
+	Height    int    `xml:"height,attr"`
+}
+
+// EmoticonMessage is an emoticon (sticker) message.
+type EmoticonMessage struct {
+	*AddMsg
+	Emoji EmojiXML
+}
+
+// Raw implements Message.
+func (m *EmoticonMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *EmoticonMessage) String() string { return "[Emoticon]" }
+
+// AppMsgXML is the payload of an app message.
+type AppMsgXML struct {
+	AppID       string `xml:"appid,attr"`
+	Title       string `xml:"title"`
+	Description string `xml:"des"`
+	Type        int    `xml:"type"`
+	URL         string `xml:"url"`
+	Attach      struct {
+		TotalLen int    `xml:"totallen"`
+		AttachID string `xml:"attachid"`
+		FileExt  string `xml:"fileext"`
+	} `xml:"appattach"`
+}
+
+// AppMessage is an app message: a shared link, file, music and so on.
+type AppMessage struct {
+	*AddMsg
+	App AppMsgXML
+}
+
+// Raw implements Message.
+func (m *AppMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *AppMessage) String() string {
+	switch m.AppMsgType {
+	case AppMsgTypeFile:
+		return fmt.Sprintf("[File: %s]", m.App.Title)
+	case AppMsgTypeURL:
+		return fmt.Sprintf("[Link: %s %s]", m.App.Title, m.App.URL)
+	}
+	return fmt.Sprintf("[App: %s]", m.App.Title)
+}
+
+// SysMessage is a system notice, e.g. a recalled message or a new group
+// member.
+type SysMessage struct {
+	*AddMsg
+	Text string
+}
+
+// Raw implements Message.
+func (m *SysMessage) Raw() *AddMsg { return m.AddMsg }
+
+func (m *SysMessage) String() string { return m.Text }
+
+// unescapeContent turns the HTML escaped Content into plain text.
+func unescapeContent(content string) string {
+	return html.UnescapeString(strings.Replace(content, "<br/>", "\n", -1))
+}
+
+// unmarshalPayload parses the XML payload in content into v. Anything before
+// the XML, like the sender prefix of group messages, is skipped.
+func unmarshalPayload(content string, v interface{}) error {
+	content = unescapeContent(content)
+	i := strings.Index(content, "<")
+	if i < 0 {
+		return fmt.Errorf("no XML in content: %q", content)
+	}
+	if err := xml.Unmarshal([]byte(content[i:]), v); err != nil {
+		return fmt.Errorf("error on unmarshal XML: %v", err)
+	}
+	return nil
+}
+
+// Decode decodes msg according to its MsgType.
+func Decode(msg *AddMsg) (Message, error) {
+	switch msg.MsgType {
+	case MsgTypeText:
+		return &TextMessage{AddMsg: msg, Text: unescapeContent(msg.Content)}, nil
+	case MsgTypeImage:
+		m := &ImageMessage{AddMsg: msg}
+		var p struct {
+			Img ImageXML `xml:"img"`
+		}
+		if err := unmarshalPayload(msg.Content, &p); err != nil {
+			return nil, err
+		}
+		m.Image = p.Img
+		return m, nil
+	case MsgTypeVoice:
+		m := &VoiceMessage{AddMsg: msg}
+		var p struct {
+			Voice VoiceXML `xml:"voicemsg"`
+		}
+		if err := unmarshalPayload(msg.Content, &p); err != nil {
+			return nil, err
+		}
+		m.Voice = p.Voice
+		return m, nil
+	case MsgTypeVideo, MsgTypeMicroVideo:
+		m := &VideoMessage{AddMsg: msg}
+		var p struct {
+			Video VideoXML `xml:"videomsg"`
+		}
+		if err := unmarshalPayload(msg.Content, &p); err != nil {
+			return nil, err
+		}
+		m.Video = p.Video
+		return m, nil
+	case MsgTypeEmoticon:
+		m := &EmoticonMessage{AddMsg: msg}
+		// Stickers from the store come without a payload.
+		if strings.Contains(msg.Content, "emoji") {
+			var p struct {
+				Emoji EmojiXML `xml:"emoji"`
+			}
+			if err := unmarshalPayload(msg.Content, &p); err != nil {
+				return nil, err
+			}
+			m.Emoji = p.Emoji
+		}
+		return m, nil
+	case MsgTypeApp:
+		m := &AppMessage{AddMsg: msg}
+		var p struct {
+			App AppMsgXML `xml:"appmsg"`
+		}
+		if err := unmarshalPayload(msg.Content, &p); err != nil {
+			return nil, err
+		}
+		m.App = p.App
+		return m, nil
+	case MsgTypeSys, MsgTypeSysNotice:
+		return &SysMessage{AddMsg: msg, Text: unescapeContent(msg.Content)}, nil
+	case MsgTypeRecalled:
+		var p struct {
+			ReplaceMsg string `xml:"revokemsg>replacemsg"`
+		}
+		if err := unmarshalPayload(msg.Content, &p); err != nil {
+			return nil, err
+		}
+		return &SysMessage{AddMsg: msg, Text: p.ReplaceMsg}, nil
+	}
+	return nil, fmt.Errorf("unsupported message type: %d", msg.MsgType)
+}
@@ -0,0 +1,72 @@
+package wechat
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		msg  *AddMsg
+		want string
+	}{
+		{
+			msg:  &AddMsg{MsgType: MsgTypeText, Content: "a &amp; b<br/>c"},
+			want: "a & b\nc",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeImage, Content: `&lt;?xml version="1.0"?&gt;<br/>&lt;msg&gt;&lt;img aeskey="k" length="10" md5="m" /&gt;&lt;/msg&gt;`},
+			want: "[Image]",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeVoice, VoiceLength: 2500, Content: `&lt;msg&gt;&lt;voicemsg voicelength="2500" length="100" /&gt;&lt;/msg&gt;`},
+			want: "[Voice 3s]",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeMicroVideo, PlayLength: 5, Content: `&lt;msg&gt;&lt;videomsg playlength="5" /&gt;&lt;/msg&gt;`},
+			want: "[Video 5s]",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeEmoticon},
+			want: "[Emoticon]",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeApp, AppMsgType: AppMsgTypeFile, Content: `&lt;msg&gt;&lt;appmsg appid=""&gt;&lt;title&gt;a.pdf&lt;/title&gt;&lt;type&gt;6&lt;/type&gt;&lt;appattach&gt;&lt;fileext&gt;pdf&lt;/fileext&gt;&lt;/appattach&gt;&lt;/appmsg&gt;&lt;/msg&gt;`},
+			want: "[File: a.pdf]",
+		},
+		{
+			msg:  &AddMsg{MsgType: MsgTypeRecalled, Content: `&lt;sysmsg type="revokemsg"&gt;&lt;revokemsg&gt;&lt;replacemsg&gt;&lt;![CDATA["a" recalled a message]]&gt;&lt;/replacemsg&gt;&lt;/revokemsg&gt;&lt;/sysmsg&gt;`},
+			want: `"a" recalled a message`,
+		},
+	} {
+		m, err := Decode(tc.msg)
+		if err != nil {
+			t.Errorf("Decode(%+v) failed: %v", tc.msg, err)
+			continue
+		}
+		if m.Raw() != tc.msg {
+			t.Errorf("Raw() = %p, want %p", m.Raw(), tc.msg)
+		}
+		if got := m.String(); got != tc.want {
+			t.Errorf("Decode(%+v) = %q, want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeAppMessage(t *testing.T) {
+	msg := &AddMsg{
+		MsgType:    MsgTypeApp,
+		AppMsgType: AppMsgTypeURL,
+		Content:    `sender:<br/>&lt;msg&gt;&lt;appmsg&gt;&lt;title&gt;T&lt;/title&gt;&lt;url&gt;http://a/?b=1&amp;amp;c=2&lt;/url&gt;&lt;/appmsg&gt;&lt;/msg&gt;`,
+	}
+	m, err := Decode(msg)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	app, ok := m.(*AppMessage)
+	if !ok {
+		t.Fatalf("Decode returned %T, want *AppMessage", m)
+	}
+	if app.App.URL != "http://a/?b=1&c=2" {
+		t.Errorf("URL = %s, want %s", app.App.URL, "http://a/?b=1&c=2")
+	}
+}
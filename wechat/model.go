@@ -55,12 +55,53 @@ type BaseResponse struct {
 
 // AddMsg is new message.
 type AddMsg struct {
-	MsgID        string `json:"MsgId"`
-	MsgType      int    `json:"MsgType"`
-	Content      string `json:"Content"`
-	FromUserName string `json:"FromUserName"`
-	ToUserName   string `json:"ToUserName"`
-	NickName     string
+	MsgID                string         `json:"MsgId"`
+	NewMsgID             int64          `json:"NewMsgId"`
+	MsgType              int            `json:"MsgType"`
+	Content              string         `json:"Content"`
+	FromUserName         string         `json:"FromUserName"`
+	ToUserName           string         `json:"ToUserName"`
+	CreateTime           int64          `json:"CreateTime"`
+	Status               int            `json:"Status"`
+	ImgStatus            int            `json:"ImgStatus"`
+	ImgHeight            int            `json:"ImgHeight"`
+	ImgWidth             int            `json:"ImgWidth"`
+	VoiceLength          int            `json:"VoiceLength"`
+	PlayLength           int            `json:"PlayLength"`
+	URL                  string         `json:"Url"`
+	FileName             string         `json:"FileName"`
+	FileSize             string         `json:"FileSize"`
+	MediaID              string         `json:"MediaId"`
+	EncryFileName        string         `json:"EncryFileName"`
+	AppMsgType           int            `json:"AppMsgType"`
+	SubMsgType           int            `json:"SubMsgType"`
+	RecommendInfo        *RecommendInfo `json:"RecommendInfo"`
+	StatusNotifyCode     int            `json:"StatusNotifyCode"`
+	StatusNotifyUserName string         `json:"StatusNotifyUserName"`
+	NickName             string
+	// SenderUserName is who sent the message. It differs from FromUserName
+	// for group messages, whose FromUserName is the group.
+	SenderUserName string
+	// GroupNickName is the name of the group of a group message.
+	GroupNickName string
+	// MentionedMe is whether the message @-mentions the logged in user.
+	MentionedMe bool
+}
+
+// RecommendInfo is the contact card in a friend request or a shared card.
+type RecommendInfo struct {
+	UserName   string `json:"UserName"`
+	NickName   string `json:"NickName"`
+	Alias      string `json:"Alias"`
+	Province   string `json:"Province"`
+	City       string `json:"City"`
+	Signature  string `json:"Signature"`
+	Content    string `json:"Content"`
+	Ticket     string `json:"Ticket"`
+	Sex        int    `json:"Sex"`
+	Scene      int    `json:"Scene"`
+	VerifyFlag int    `json:"VerifyFlag"`
+	OpCode     int    `json:"OpCode"`
 }
 
 // Msg is message to send.
@@ -71,12 +112,51 @@ type Msg struct {
 	ClientMsgID  int    `json:"ClientMsgId"`
 	LocalID      int    `json:"LocalID"`
 	Type         int    `json:"Type"`
+	MediaID      string `json:"MediaId,omitempty"`
+	EmojiFlag    int    `json:"EmojiFlag,omitempty"`
 }
 
 // Member is contact.
 type Member struct {
-	UserName string `json:"UserName"`
-	NickName string `json:"NickName"`
+	UserName    string `json:"UserName"`
+	NickName    string `json:"NickName"`
+	RemarkName  string `json:"RemarkName"`
+	Alias       string `json:"Alias"`
+	Sex         int    `json:"Sex"`
+	Province    string `json:"Province"`
+	City        string `json:"City"`
+	Signature   string `json:"Signature"`
+	VerifyFlag  int    `json:"VerifyFlag"`
+	ContactFlag int    `json:"ContactFlag"`
+	HeadImgURL  string `json:"HeadImgUrl"`
+	// DisplayName is the alias of a group member within the group.
+	DisplayName     string    `json:"DisplayName"`
+	EncryChatRoomID string    `json:"EncryChatRoomId"`
+	MemberCount     int       `json:"MemberCount"`
+	MemberList      []*Member `json:"MemberList"`
+}
+
+// IsGroup returns whether m is a group chat.
+func (m *Member) IsGroup() bool {
+	return strings.HasPrefix(m.UserName, "@@")
+}
+
+// Name returns the name of m as shown in a group.
+func (m *Member) Name() string {
+	if m.DisplayName != "" {
+		return m.DisplayName
+	}
+	return m.NickName
+}
+
+// GroupMember returns the member of group m with the given user name.
+func (m *Member) GroupMember(userName string) *Member {
+	for _, member := range m.MemberList {
+		if member.UserName == userName {
+			return member
+		}
+	}
+	return nil
 }
 
 // BaseResponseJSON is.
@@ -86,17 +166,27 @@ type BaseResponseJSON struct {
 	AddMsgCount  int           `json:"AddMsgCount"`
 	AddMsgList   []*AddMsg     `json:"AddMsgList"`
 	MemberList   []*Member     `json:"MemberList"`
+	// Seq is set by webwxgetcontact. It is 0 on the last page.
+	Seq int `json:"Seq"`
+	// ContactList is set by webwxbatchgetcontact.
+	ContactList []*Member `json:"ContactList"`
+	// MediaID is set by webwxuploadmedia.
+	MediaID string `json:"MediaId"`
+	// ModContactList and DelContactList are set by webwxsync.
+	ModContactList []*Member `json:"ModContactList"`
+	DelContactList []*Member `json:"DelContactList"`
+}
+
+// initResponse is the response of webwxinit.
+type initResponse struct {
+	BaseResponse *BaseResponse `json:"BaseResponse"`
+	SyncKey      *SyncKey      `json:"SyncKey"`
+	User         *Member       `json:"User"`
 }
 
-// SyncRes holds the result for syncing with the server.
-//    retcode: 0    successful
-//	     1100 logout
-//	     1101 login otherwhere
-//    selector: 0 nothing
-//	      2 message
-//	      6 unkonwn
-//	      7 webwxsync
+// SyncRes holds the result for syncing with the server. See Retcode and
+// Selector for the values.
 type SyncRes struct {
-	Retcode  string
-	Selector string
+	Retcode  Retcode
+	Selector Selector
 }
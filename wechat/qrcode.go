@@ -0,0 +1,112 @@
+package wechat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/golang/glog"
+	"rsc.io/qr"
+)
+
+// QRPresenter shows the login QR code to whoever is going to scan it.
+type QRPresenter interface {
+	// Present is called with the URL encoded in the QR code and the QR
+	// image fetched from the server.
+	Present(loginURL string, img []byte) error
+}
+
+// FilePresenter saves the QR image to Path and opens it with the desktop
+// image viewer if there is one.
+type FilePresenter struct {
+	Path string
+}
+
+// Present implements QRPresenter.
+func (p *FilePresenter) Present(loginURL string, img []byte) error {
+	if err := ioutil.WriteFile(p.Path, img, 0644); err != nil {
+		return fmt.Errorf("error writing QR image: %v", err)
+	}
+	abs, err := filepath.Abs(p.Path)
+	if err != nil {
+		abs = p.Path
+	}
+	glog.Infof("Please scan QR code from you phone:\nfile://%s", abs)
+	displayQRCode(p.Path)
+	return nil
+}
+
+func displayQRCode(path string) {
+	switch runtime.GOOS {
+	case "linux":
+		cmd := exec.Command("xdg-open", path)
+		cmd.Start()
+	case "darwin":
+		cmd := exec.Command("open", path)
+		cmd.Start()
+	}
+}
+
+// TerminalPresenter renders the QR code as block art to Out, which defaults
+// to os.Stderr, followed by the login URL as plain text. It works without a
+// display, e.g. in containers.
+type TerminalPresenter struct {
+	Out io.Writer
+}
+
+// Present implements QRPresenter.
+func (p *TerminalPresenter) Present(loginURL string, img []byte) error {
+	out := p.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	art, err := renderQR(loginURL)
+	if err != nil {
+		return fmt.Errorf("error encoding QR code: %v", err)
+	}
+	_, err = fmt.Fprintf(out, "Please scan QR code from you phone:\n%s%s\n", art, loginURL)
+	return err
+}
+
+// quietZone is the number of white modules around the QR code.
+const quietZone = 2
+
+// renderQR encodes text as a QR code and renders it with ANSI colored half
+// blocks, two modules per character, so it reads well on both dark and
+// light terminals.
+func renderQR(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+	// black reports whether the module at (x, y) is dark, including the
+	// quiet zone.
+	black := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return false
+		}
+		return code.Black(x, y)
+	}
+	color := func(dark bool) int {
+		if dark {
+			return 0
+		}
+		return 7
+	}
+	var b bytes.Buffer
+	size := code.Size + 2*quietZone
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			// Foreground is the upper module, background the lower one.
+			fmt.Fprintf(&b, "\x1b[3%d;4%dm▀", color(black(x, y)), color(black(x, y+1)))
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.String(), nil
+}
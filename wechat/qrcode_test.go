@@ -0,0 +1,24 @@
+package wechat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTerminalPresenter(t *testing.T) {
+	var b bytes.Buffer
+	p := &TerminalPresenter{Out: &b}
+	url := loginURL(DefaultLoginHost, "abc==")
+	if err := p.Present(url, nil); err != nil {
+		t.Fatalf("Present failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if got := lines[len(lines)-1]; got != "https://login.weixin.qq.com/l/abc==" {
+		t.Errorf("last line = %q, want the login URL", got)
+	}
+	// A version 3 code is 29 modules plus the quiet zone, two rows per line.
+	if got, want := len(lines)-2, (29+2*quietZone+1)/2; got != want {
+		t.Errorf("got %d lines of QR code, want %d", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// redacted replaces the secrets in recordings.
+const redacted = "REDACTED"
+
+// Patterns of the secrets redacted from recordings: query parameters in URLs
+// and bodies, JSON fields, the XML of the redirect page and the form fields
+// of multipart uploads.
+var (
+	redactQueryRe     = regexp.MustCompile(`(?i)([?&](?:sid|skey|pass_ticket|ticket|webwx_data_ticket)=)[^&"'\s]*`)
+	redactJSONRe      = regexp.MustCompile(`(?i)("(?:sid|skey|pass_ticket|webwx_data_ticket)"\s*:\s*")(?:[^"\\]|\\.)*"`)
+	redactXMLRe       = regexp.MustCompile(`(?i)(<(skey|wxsid|pass_ticket)>)[^<]*(</)`)
+	redactMultipartRe = regexp.MustCompile(`(?i)(name="(?:sid|skey|pass_ticket|webwx_data_ticket)"\r\n(?:[^\r\n]+\r\n)*\r\n)[^\r\n]*`)
+	redactCookie      = regexp.MustCompile(`^([^=]*=)[^;]*`)
+)
+
+// Redact replaces the Sid, Skey, pass_ticket and login tickets in s.
+func Redact(s string) string {
+	return string(redact([]byte(s)))
+}
+
+// redact is like Redact but works on any bytes, e.g. a multipart upload
+// whose file is not UTF-8.
+func redact(b []byte) []byte {
+	b = redactQueryRe.ReplaceAll(b, []byte("${1}"+redacted))
+	b = redactJSONRe.ReplaceAll(b, []byte(`${1}`+redacted+`"`))
+	b = redactXMLRe.ReplaceAll(b, []byte("${1}"+redacted+"${3}"))
+	return redactMultipartRe.ReplaceAll(b, []byte("${1}"+redacted))
+}
+
+// Body is a recorded request or response body. Text holds UTF-8 bodies and
+// Base64 the others.
+type Body struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+func newBody(b []byte) *Body {
+	if len(b) == 0 {
+		return nil
+	}
+	b = redact(b)
+	if utf8.Valid(b) {
+		return &Body{Text: string(b)}
+	}
+	return &Body{Base64: base64.StdEncoding.EncodeToString(b)}
+}
+
+// Bytes returns the content of b.
+func (b *Body) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	if b.Base64 != "" {
+		d, _ := base64.StdEncoding.DecodeString(b.Base64)
+		return d
+	}
+	return []byte(b.Text)
+}
+
+// Exchange is a recorded request and its response.
+type Exchange struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	// Header has the extra request headers, e.g. Range.
+	Header         http.Header `json:"header,omitempty"`
+	Request        *Body       `json:"request,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	Response       *Body       `json:"response,omitempty"`
+	// Error is set if no response was received.
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder is an HTTPClient that writes every request and response of
+// Client to Out as JSON lines, one Exchange per line. Sid, Skey, pass_ticket
+// and cookies are redacted.
+type Recorder struct {
+	Client HTTPClient
+	Out    io.Writer
+
+	mu sync.Mutex
+}
+
+// NewRecorder returns a Recorder of c writing to out.
+func NewRecorder(c HTTPClient, out io.Writer) *Recorder {
+	return &Recorder{Client: c, Out: out}
+}
+
+// Jar returns the cookie jar of r.Client, if any.
+func (r *Recorder) Jar() http.CookieJar {
+	return clientJar(r.Client)
+}
+
+// Do implements HTTPClient.
+func (r *Recorder) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return r.DoContext(context.Background(), method, url, nil, body)
+}
+
+// DoContext implements ContextHTTPClient.
+func (r *Recorder) DoContext(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	e := &Exchange{Time: time.Now(), Method: method, URL: Redact(url), Header: header}
+	if body != nil {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading body: %v", err)
+		}
+		e.Request = newBody(b)
+		body = bytes.NewReader(b)
+	}
+	var resp *http.Response
+	var err error
+	if c, ok := r.Client.(ContextHTTPClient); ok {
+		resp, err = c.DoContext(ctx, method, url, header, body)
+	} else {
+		resp, err = r.Client.Do(method, url, body)
+	}
+	if err != nil {
+		e.Error = err.Error()
+		r.write(e)
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		e.Error = err.Error()
+		r.write(e)
+		return nil, fmt.Errorf("error reading body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	e.Status = resp.StatusCode
+	e.ResponseHeader = redactHeader(resp.Header)
+	e.Response = newBody(b)
+	r.write(e)
+	return resp, nil
+}
+
+func (r *Recorder) write(e *Exchange) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Out.Write(append(b, '\n'))
+}
+
+// redactHeader returns a copy of h with the cookie values redacted.
+func redactHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, vs := range h {
+		vs = append([]string(nil), vs...)
+		if http.CanonicalHeaderKey(k) == "Set-Cookie" {
+			for i, v := range vs {
+				vs[i] = redactCookie.ReplaceAllString(v, "${1}"+redacted)
+			}
+		}
+		res[k] = vs
+	}
+	return res
+}
+
+// ReadExchanges reads the exchanges written by a Recorder.
+func ReadExchanges(r io.Reader) ([]*Exchange, error) {
+	var res []*Exchange
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		e := &Exchange{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("error on unmarshal: %v", err)
+		}
+		res = append(res, e)
+	}
+	return res, s.Err()
+}
+
+// Replayer is an HTTPClient that answers with recorded exchanges instead of
+// going to the network. A request gets the first unused exchange with the
+// same method, host and path, so query parameters like timestamps and the
+// redacted secrets do not need to match.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	used      []bool
+}
+
+// NewReplayer returns a Replayer of exchanges.
+func NewReplayer(exchanges []*Exchange) *Replayer {
+	return &Replayer{exchanges: exchanges, used: make([]bool, len(exchanges))}
+}
+
+// Do implements HTTPClient.
+func (r *Replayer) Do(method, rawurl string, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.exchanges {
+		if r.used[i] || e.Method != method {
+			continue
+		}
+		eu, err := url.Parse(e.URL)
+		if err != nil || eu.Host != u.Host || eu.Path != u.Path {
+			continue
+		}
+		r.used[i] = true
+		if e.Error != "" {
+			return nil, fmt.Errorf("recorded error: %s", e.Error)
+		}
+		b := e.Response.Bytes()
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+			StatusCode:    e.Status,
+			Header:        e.ResponseHeader,
+			Body:          ioutil.NopCloser(bytes.NewReader(b)),
+			ContentLength: int64(len(b)),
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded exchange for %s %s", method, Redact(rawurl))
+}
+
+// Remaining returns how many exchanges have not been replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, used := range r.used {
+		if !used {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package wechat
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{
+			"https://wx2.qq.com/cgi-bin/mmwebwx-bin/synccheck?r=1&sid=abc&uin=42&skey=%40crypt_1&synckey=1_2",
+			"https://wx2.qq.com/cgi-bin/mmwebwx-bin/synccheck?r=1&sid=REDACTED&uin=42&skey=REDACTED&synckey=1_2",
+		},
+		{
+			`{"BaseRequest":{"DeviceID":"e1","Sid":"abc","Skey":"@crypt_1","Uin":"42"},"SKey": "@crypt_2"}`,
+			`{"BaseRequest":{"DeviceID":"e1","Sid":"REDACTED","Skey":"REDACTED","Uin":"42"},"SKey": "REDACTED"}`,
+		},
+		{
+			"<error><ret>0</ret><skey>@crypt_1</skey><wxsid>abc</wxsid><pass_ticket>p</pass_ticket></error>",
+			"<error><ret>0</ret><skey>REDACTED</skey><wxsid>REDACTED</wxsid><pass_ticket>REDACTED</pass_ticket></error>",
+		},
+		{
+			"--b\r\nContent-Disposition: form-data; name=\"pass_ticket\"\r\n\r\np\r\n--b\r\nContent-Disposition: form-data; name=\"webwx_data_ticket\"\r\n\r\nt\r\n--b--",
+			"--b\r\nContent-Disposition: form-data; name=\"pass_ticket\"\r\n\r\nREDACTED\r\n--b\r\nContent-Disposition: form-data; name=\"webwx_data_ticket\"\r\n\r\nREDACTED\r\n--b--",
+		},
+		{
+			`window.redirect_uri="https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=t&uuid=u";`,
+			`window.redirect_uri="https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=REDACTED&uuid=u";`,
+		},
+	} {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		resp := newResponse(200, `{"BaseResponse": {"Ret": 0}, "SKey": "@crypt_1"}`)
+		if strings.Contains(url, "webwxgetmsgimg") {
+			resp = newResponse(200, "\xff\xd8\xff")
+		}
+		resp.Header = http.Header{"Set-Cookie": {"wxsid=abc; Path=/"}}
+		return resp, nil
+	})
+	var out bytes.Buffer
+	r := NewRecorder(c, &out)
+	resp, err := r.Do("POST", "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxinit?pass_ticket=p&r=1", strings.NewReader(`{"Sid":"abc"}`))
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); !strings.Contains(string(b), "@crypt_1") {
+		t.Errorf("caller got %q, want the unredacted body", b)
+	}
+	if _, err := r.Do("GET", "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxgetmsgimg?MsgID=1", nil); err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	for _, secret := range []string{"abc", "@crypt_1", "pass_ticket=p"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("recording has %q: %s", secret, out.String())
+		}
+	}
+
+	exchanges, err := ReadExchanges(&out)
+	if err != nil {
+		t.Fatalf("ReadExchanges failed: %v", err)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("got %d exchanges, want 2", len(exchanges))
+	}
+	p := NewReplayer(exchanges)
+	resp, err = p.Do("GET", "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxgetmsgimg?MsgID=1", nil)
+	if err != nil {
+		t.Fatalf("replaying failed: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "\xff\xd8\xff" {
+		t.Errorf("replayed %q, want the image", b)
+	}
+	resp, err = p.Do("POST", "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxinit?pass_ticket=q&r=2", nil)
+	if err != nil {
+		t.Fatalf("replaying failed: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 200 || !strings.Contains(string(b), `"Ret": 0`) {
+		t.Errorf("replayed %d %q, want the webwxinit response", resp.StatusCode, b)
+	}
+	if _, err := p.Do("POST", "https://wx2.qq.com/cgi-bin/mmwebwx-bin/webwxinit", nil); err == nil {
+		t.Errorf("replaying an exchange twice succeeded, want error")
+	}
+	if n := p.Remaining(); n != 0 {
+		t.Errorf("Remaining() = %d, want 0", n)
+	}
+}
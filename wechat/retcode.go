@@ -0,0 +1,93 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Retcode is the retcode of synccheck.
+type Retcode string
+
+// The known retcodes.
+const (
+	// RetcodeOK means the session is alive.
+	RetcodeOK Retcode = "0"
+	// RetcodeLoggedOut means the user logged out, e.g. from the phone.
+	RetcodeLoggedOut Retcode = "1100"
+	// RetcodeLoginElsewhere means the account logged in on another web or
+	// desktop client.
+	RetcodeLoginElsewhere Retcode = "1101"
+	// RetcodeSessionInvalid means the session is not valid, e.g. it
+	// expired or its cookies are missing.
+	RetcodeSessionInvalid Retcode = "1102"
+)
+
+// Errors for the retcodes that end the session. ErrLoginElsewhere and
+// ErrSessionInvalid also match ErrSessionExpired, like the Ret values of
+// the API.
+var (
+	ErrLoggedOut      = errors.New("logged out")
+	ErrLoginElsewhere = &sessionError{"logged in elsewhere"}
+	ErrSessionInvalid = &sessionError{"session invalid"}
+	errUnknownRetcode = errors.New("unknown retcode")
+)
+
+// sessionError is a more specific ErrSessionExpired.
+type sessionError struct {
+	msg string
+}
+
+func (e *sessionError) Error() string { return e.msg }
+
+func (e *sessionError) Unwrap() error { return ErrSessionExpired }
+
+// Err returns nil for RetcodeOK, and otherwise an error telling why the
+// session ended. Use errors.Is to check for ErrLoggedOut and the like, or
+// ErrSessionExpired for either of ErrLoginElsewhere and ErrSessionInvalid.
+func (r Retcode) Err() error {
+	switch r {
+	case RetcodeOK:
+		return nil
+	case RetcodeLoggedOut:
+		return ErrLoggedOut
+	case RetcodeLoginElsewhere:
+		return ErrLoginElsewhere
+	case RetcodeSessionInvalid:
+		return ErrSessionInvalid
+	}
+	return fmt.Errorf("%w: %s", errUnknownRetcode, string(r))
+}
+
+// Selector is the selector of synccheck. It says what changed.
+type Selector string
+
+// The known selectors.
+const (
+	// SelectorNone means nothing changed.
+	SelectorNone Selector = "0"
+	// SelectorNewMsg means there are new messages.
+	SelectorNewMsg Selector = "2"
+	// SelectorModContact means a contact changed.
+	SelectorModContact Selector = "4"
+	// SelectorAddOrDelContact means contacts were added or deleted.
+	SelectorAddOrDelContact Selector = "6"
+	// SelectorEnterOrLeaveChat means a chat was opened or closed on the
+	// phone.
+	SelectorEnterOrLeaveChat Selector = "7"
+)
+
+// NeedsSync returns whether webwxsync must be called to get the changes
+// and advance the SyncKey. This is true for any selector but
+// SelectorNone, including unknown ones.
+func (s Selector) NeedsSync() bool {
+	return s != SelectorNone
+}
+
+// Known returns whether s is one of the known selectors.
+func (s Selector) Known() bool {
+	switch s {
+	case SelectorNone, SelectorNewMsg, SelectorModContact, SelectorAddOrDelContact, SelectorEnterOrLeaveChat:
+		return true
+	}
+	return false
+}
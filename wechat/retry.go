@@ -0,0 +1,128 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RetryPolicy decides how failed API calls are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of tries, including the first one.
+	// Values below 1 mean 1.
+	MaxAttempts int
+	// InitialDelay is the wait before the first retry. Zero means retrying
+	// right away, e.g. in tests.
+	InitialDelay time.Duration
+	// MaxDelay caps the wait. Zero means no cap.
+	MaxDelay time.Duration
+	// Multiplier grows the wait after each retry. Values below 1 mean 1.
+	Multiplier float64
+	// Jitter randomizes each wait by up to this fraction of it, e.g. 0.2
+	// for ±20%.
+	Jitter float64
+	// Retryable decides whether an error is worth retrying. Defaults to
+	// IsRetryable.
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy is used when Wechat.RetryPolicy is nil.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// Delay returns the wait after the given failed attempt, starting at 1.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	d := float64(p.InitialDelay) * math.Pow(m, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// IsRetryable returns whether err may go away by retrying: requests that
+// got no response, rate limiting, and 408 and 5xx responses. Everything
+// else is permanent, e.g. other Ret values, an ended session or a body
+// that does not decode. Context errors are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var t *transportError
+	if errors.As(err, &t) {
+		return true
+	}
+	var e *APIError
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Ret == 0 && (e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500)
+}
+
+// retryPolicy returns w.RetryPolicy or the default.
+func (w *Wechat) retryPolicy() *RetryPolicy {
+	if w.RetryPolicy != nil {
+		return w.RetryPolicy
+	}
+	return DefaultRetryPolicy
+}
+
+// Do calls f until it succeeds, fails with an error that is not retryable,
+// or runs out of attempts. name is used in logs.
+func (p *RetryPolicy) Do(ctx context.Context, name string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= p.attempts() || !p.retryable(err) {
+			return err
+		}
+		d := p.Delay(attempt)
+		glog.Warningf("%s failed on attempt %d/%d: %v. Retrying in %v", name, attempt, p.attempts(), err, d)
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// retry calls f with w.retryPolicy().
+func (w *Wechat) retry(ctx context.Context, name string, f func() error) error {
+	return w.retryPolicy().Do(ctx, name, f)
+}
@@ -0,0 +1,135 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if got := p.Delay(attempt + 1); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt+1, got, want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("Delay(1) with jitter = %v, want within 0.5s-1.5s", d)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("error on POST: %w", &transportError{errors.New("connection reset")}), true},
+		{errors.New("error on unmarshal: unexpected EOF"), false},
+		{ErrLoginElsewhere, false},
+		{fmt.Errorf("session ended: %w", ErrSessionInvalid), false},
+		{context.Canceled, false},
+		{fmt.Errorf("error on POST: %w", context.DeadlineExceeded), false},
+		{&APIError{StatusCode: 503}, true},
+		{&APIError{StatusCode: 429}, true},
+		{&APIError{StatusCode: 404}, false},
+		{&APIError{StatusCode: 200, Ret: 1205}, true},
+		{&APIError{StatusCode: 200, Ret: 1101}, false},
+		{&APIError{StatusCode: 200, Ret: 1}, false},
+		{fmt.Errorf("error on init: %w", &APIError{StatusCode: 200, Ret: 1100}), false},
+	} {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%#v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSendMsgRetry(t *testing.T) {
+	var responses []*http.Response
+	calls := 0
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		calls++
+		resp := responses[0]
+		responses = responses[1:]
+		if resp == nil {
+			return nil, errors.New("connection reset")
+		}
+		return resp, nil
+	})
+	w := &Wechat{
+		Client:          c,
+		baseRequestJSON: &BaseRequestJSON{BaseRequest: &BaseRequest{}},
+		user:            &Member{UserName: "@me"},
+		RetryPolicy:     &RetryPolicy{MaxAttempts: 3},
+	}
+
+	responses = []*http.Response{
+		newResponse(502, ""),
+		newResponse(200, `{"BaseResponse": {"Ret": 1205}}`),
+		newResponse(200, `{"BaseResponse": {"Ret": 0}}`),
+	}
+	if err := w.SendMsg(&Msg{Type: MsgTypeText, Content: "hi", ToUserName: "@a"}); err != nil {
+		t.Errorf("SendMsg: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+
+	// A failed connection is retried, an unknown Ret is not.
+	calls = 0
+	responses = []*http.Response{nil, newResponse(200, `{"BaseResponse": {"Ret": 0}}`)}
+	if err := w.SendMsg(&Msg{Type: MsgTypeText, Content: "hi", ToUserName: "@a"}); err != nil || calls != 2 {
+		t.Errorf("SendMsg after a failed connection = %v with %d calls, want success with 2", err, calls)
+	}
+	calls = 0
+	responses = []*http.Response{newResponse(200, `{"BaseResponse": {"Ret": 1}}`)}
+	if err := w.SendMsg(&Msg{Type: MsgTypeText, Content: "hi", ToUserName: "@a"}); err == nil || calls != 1 {
+		t.Errorf("SendMsg with Ret 1 = %v with %d calls, want an error with 1", err, calls)
+	}
+
+	calls = 0
+	responses = []*http.Response{newResponse(200, `{"BaseResponse": {"Ret": 1101, "ErrMsg": "expired"}}`)}
+	err := w.SendMsg(&Msg{Type: MsgTypeText, Content: "hi", ToUserName: "@a"})
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("SendMsg returned %v, want ErrSessionExpired", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("SendMsg returned %T, want *APIError", err)
+	}
+	if want := (&APIError{Endpoint: "webwxsendmsg", StatusCode: 200, Ret: 1101, ErrMsg: "expired"}); *apiErr != *want {
+		t.Errorf("SendMsg returned %+v, want %+v", apiErr, want)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1 as the session ended", calls)
+	}
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	for _, tt := range []struct {
+		err    *APIError
+		target error
+		want   bool
+	}{
+		{&APIError{StatusCode: 200, Ret: 1101}, ErrSessionExpired, true},
+		{&APIError{StatusCode: 200, Ret: 1102}, ErrSessionExpired, true},
+		{&APIError{StatusCode: 200, Ret: 1100}, ErrLoggedOut, true},
+		{&APIError{StatusCode: 200, Ret: 1100}, ErrSessionExpired, false},
+		{&APIError{StatusCode: 200, Ret: 1101}, ErrLoginElsewhere, true},
+		{&APIError{StatusCode: 200, Ret: 1102}, ErrSessionInvalid, true},
+		{&APIError{StatusCode: 200, Ret: 1101}, ErrSessionInvalid, false},
+		{&APIError{StatusCode: 200, Ret: 1205}, ErrRateLimited, true},
+		{&APIError{StatusCode: 429}, ErrRateLimited, true},
+		{&APIError{StatusCode: 500}, ErrRateLimited, false},
+	} {
+		if got := errors.Is(fmt.Errorf("error on init: %w", tt.err), tt.target); got != tt.want {
+			t.Errorf("errors.Is(%+v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// CookieJarClient is an HTTPClient whose cookies can be saved and restored.
+type CookieJarClient interface {
+	HTTPClient
+	Jar() http.CookieJar
+}
+
+// clientJar returns the cookie jar of c, or nil if it does not keep cookies.
+func clientJar(c HTTPClient) http.CookieJar {
+	if c, ok := c.(CookieJarClient); ok {
+		return c.Jar()
+	}
+	return nil
+}
+
+// session is what gets persisted to Wechat.SessionFile.
+type session struct {
+	Host            string                    `json:"Host"`
+	LoginInfo       *LoginInfo                `json:"LoginInfo"`
+	BaseRequestJSON *BaseRequestJSON          `json:"BaseRequestJSON"`
+	User            *Member                   `json:"User"`
+	Cookies         map[string][]*http.Cookie `json:"Cookies"`
+	Seen            []*dedupEntry             `json:"Seen,omitempty"`
+}
+
+// cookieURLs returns the URLs whose cookies are needed by the session.
+func (w *Wechat) cookieURLs() []string {
+	e := w.endpoints()
+	urls := []string{e.Login}
+	if e.Web != "" {
+		urls = append(urls, e.Web, e.File)
+	}
+	return append(urls, e.Push...)
+}
+
+// SaveSession writes the current session to w.SessionFile.
+func (w *Wechat) SaveSession() error {
+	if w.SessionFile == "" {
+		return nil
+	}
+	w.sessionMu.RLock()
+	s := &session{
+		Host:      w.host,
+		LoginInfo: w.loginInfo,
+		User:      w.user,
+		Cookies:   make(map[string][]*http.Cookie),
+	}
+	if w.baseRequestJSON != nil {
+		// Copied, as syncing updates the SyncKey.
+		bj := *w.baseRequestJSON
+		s.BaseRequestJSON = &bj
+	}
+	w.sessionMu.RUnlock()
+	if s.BaseRequestJSON == nil {
+		return nil
+	}
+	s.Seen = w.dedup().entries()
+	if jar := clientJar(w.Client); jar != nil {
+		for _, rawurl := range w.cookieURLs() {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return fmt.Errorf("error on parsing url: %v", err)
+			}
+			s.Cookies[rawurl] = jar.Cookies(u)
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+	// Write to a temp file first so a crash never leaves a truncated session.
+	tmp := w.SessionFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("error writing session: %v", err)
+	}
+	return os.Rename(tmp, w.SessionFile)
+}
+
+// loadSession restores the session from w.SessionFile.
+func (w *Wechat) loadSession() error {
+	b, err := ioutil.ReadFile(w.SessionFile)
+	if err != nil {
+		return err
+	}
+	s := &session{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return fmt.Errorf("error on unmarshal: %v", err)
+	}
+	// Seen messages are useful even if the session is not.
+	w.dedup().restore(s.Seen)
+	if s.BaseRequestJSON == nil || s.BaseRequestJSON.BaseRequest == nil || s.BaseRequestJSON.SyncKey == nil {
+		return errors.New("incomplete session")
+	}
+	if jar := clientJar(w.Client); jar != nil {
+		for rawurl, cookies := range s.Cookies {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				return fmt.Errorf("error on parsing url: %v", err)
+			}
+			jar.SetCookies(u, cookies)
+		}
+	}
+	w.sessionMu.Lock()
+	defer w.sessionMu.Unlock()
+	w.host = s.Host
+	w.loginInfo = s.LoginInfo
+	w.baseRequestJSON = s.BaseRequestJSON
+	w.user = s.User
+	return nil
+}
+
+// Resume restores the session saved in w.SessionFile and checks that it is
+// still valid. It falls back to Login if there is no usable session.
+func (w *Wechat) Resume() error {
+	return w.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume but gives up when ctx is done.
+func (w *Wechat) ResumeContext(ctx context.Context) error {
+	if w.SessionFile == "" {
+		return w.LoginContext(ctx)
+	}
+	if err := w.resume(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		glog.Warningf("Unable to resume session from %s: %v", w.SessionFile, err)
+		w.resetSession()
+		return w.LoginContext(ctx)
+	}
+	glog.Infof("Resumed session from %s", w.SessionFile)
+	w.loadContacts(ctx)
+	return nil
+}
+
+// resetSession forgets a session that failed to resume, so that the login
+// starts from DefaultLoginHost.
+func (w *Wechat) resetSession() {
+	w.sessionMu.Lock()
+	defer w.sessionMu.Unlock()
+	w.host = ""
+	w.loginInfo = nil
+	w.baseRequestJSON = nil
+	w.user = nil
+}
+
+func (w *Wechat) resume(ctx context.Context) error {
+	if err := w.loadSession(); err != nil {
+		return err
+	}
+	sr, err := w.SyncCheckContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error on SyncCheck: %v", err)
+	}
+	if err := sr.Retcode.Err(); err != nil {
+		return fmt.Errorf("session ended: %w", err)
+	}
+	return nil
+}
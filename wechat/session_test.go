@@ -0,0 +1,130 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoadSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.json")
+
+	c := NewClient()
+	u, _ := url.Parse("https://wx2.qq.com")
+	c.(CookieJarClient).Jar().SetCookies(u, []*http.Cookie{{Name: "wxsid", Value: "sid"}})
+	w := &Wechat{
+		Client:      c,
+		SessionFile: file,
+		loginInfo:   &LoginInfo{PassTicket: "ticket"},
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{Sid: "sid", Uin: "uin"},
+			SyncKey:     &SyncKey{Count: 1, List: []map[string]int{{"Key": 1, "Val": 2}}},
+		},
+		user: &Member{UserName: "@me"},
+		host: "wx2.qq.com",
+	}
+	if err := w.SaveSession(); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+
+	w2 := &Wechat{Client: NewClient(), SessionFile: file}
+	if err := w2.loadSession(); err != nil {
+		t.Fatalf("loadSession failed: %v", err)
+	}
+	if w2.host != "wx2.qq.com" {
+		t.Errorf("host = %s, want %s", w2.host, "wx2.qq.com")
+	}
+	if got := w2.baseRequestJSON.SyncKey.String(); got != "1_2" {
+		t.Errorf("SyncKey = %s, want %s", got, "1_2")
+	}
+	if w2.loginInfo.PassTicket != "ticket" || w2.user.UserName != "@me" {
+		t.Errorf("got LoginInfo %+v, User %+v", w2.loginInfo, w2.user)
+	}
+	cookies := w2.Client.(CookieJarClient).Jar().Cookies(u)
+	if len(cookies) != 1 || cookies[0].Value != "sid" {
+		t.Errorf("cookies = %v, want wxsid=sid", cookies)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "session.json")
+	w := &Wechat{
+		Client:      NewClient(),
+		SessionFile: file,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{},
+			SyncKey:     &SyncKey{},
+		},
+		host: "wx2.qq.com",
+	}
+	if err := w.SaveSession(); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+
+	body := `window.synccheck={retcode:"0",selector:"0"}`
+	c := &stubClient{
+		resp: &http.Response{
+			StatusCode: 200,
+			Body:       &readerCloser{reader: strings.NewReader(body)},
+		},
+	}
+	w2 := &Wechat{Client: c, SessionFile: file, RetryPolicy: &RetryPolicy{MaxAttempts: 3}}
+	if err := w2.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if w2.host != "wx2.qq.com" {
+		t.Errorf("host = %s, want %s", w2.host, "wx2.qq.com")
+	}
+}
+
+func TestResumeFallback(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.json")
+	w := &Wechat{
+		Client:      NewClient(),
+		SessionFile: file,
+		baseRequestJSON: &BaseRequestJSON{
+			BaseRequest: &BaseRequest{},
+			SyncKey:     &SyncKey{},
+		},
+		host: "wx2.qq.com",
+	}
+	if err := w.SaveSession(); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+
+	var login string
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		if strings.Contains(url, "/synccheck") {
+			return newResponse(200, `window.synccheck={retcode:"1101",selector:"0"}`), nil
+		}
+		login = url
+		return nil, errors.New("stop")
+	})
+	w2 := &Wechat{Client: c, SessionFile: file, RetryPolicy: &RetryPolicy{MaxAttempts: 1}}
+	if err := w2.ResumeContext(context.Background()); err == nil {
+		t.Fatalf("ResumeContext succeeded, want the error of the login")
+	}
+	if !strings.HasPrefix(login, DefaultLoginHost+"/") {
+		t.Errorf("logged in at %s, want %s", login, DefaultLoginHost)
+	}
+	if w2.host != "" || w2.baseRequestJSON != nil {
+		t.Errorf("host, BaseRequestJSON = %q, %v, want them reset", w2.host, w2.baseRequestJSON)
+	}
+}
@@ -0,0 +1,262 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// uploadChunkSize is the size of the chunks sent to webwxuploadmedia.
+const uploadChunkSize = 512 * 1024
+
+// Upload is a file to upload and send.
+type Upload struct {
+	// Reader reads the content of the file.
+	Reader io.Reader
+	// Size is the number of bytes Reader returns.
+	Size int64
+	// Name is the file name. Its extension decides the MIME type.
+	Name string
+	// ToUserName is whom the file is sent to.
+	ToUserName string
+	// Progress, if set, is called after each uploaded chunk.
+	Progress func(sent, total int64)
+}
+
+// uploadMediaRequest is the uploadmediarequest field of webwxuploadmedia.
+type uploadMediaRequest struct {
+	UploadType    int          `json:"UploadType"`
+	BaseRequest   *BaseRequest `json:"BaseRequest"`
+	ClientMediaID int          `json:"ClientMediaId"`
+	TotalLen      int64        `json:"TotalLen"`
+	StartPos      int          `json:"StartPos"`
+	DataLen       int64        `json:"DataLen"`
+	MediaType     int          `json:"MediaType"`
+	FromUserName  string       `json:"FromUserName"`
+	ToUserName    string       `json:"ToUserName"`
+}
+
+// mediaType returns the mediatype field of webwxuploadmedia for name.
+func mediaType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp":
+		return "pic"
+	case ".mp4":
+		return "video"
+	}
+	return "doc"
+}
+
+// UploadMedia uploads u in chunks and returns its MediaId.
+func (w *Wechat) UploadMedia(u *Upload) (string, error) {
+	return w.UploadMediaContext(context.Background(), u)
+}
+
+// UploadMediaContext is like UploadMedia but gives up when ctx is done.
+func (w *Wechat) UploadMediaContext(ctx context.Context, u *Upload) (string, error) {
+	user, br := w.CurrentUser(), w.baseRequest()
+	if user == nil || br == nil {
+		return "", errors.New("not logged in")
+	}
+	host := w.endpoints().File
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxuploadmedia?f=json", host)
+	req, err := json.Marshal(&uploadMediaRequest{
+		UploadType:    2,
+		BaseRequest:   br,
+		ClientMediaID: NowUnixMilli(),
+		TotalLen:      u.Size,
+		DataLen:       u.Size,
+		MediaType:     4,
+		FromUserName:  user.UserName,
+		ToUserName:    u.ToUserName,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal: %v", err)
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(u.Name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	fields := map[string]string{
+		"id":                 "WU_FILE_0",
+		"name":               u.Name,
+		"type":               mimeType,
+		"lastModifiedDate":   time.Now().UTC().Format(time.RFC1123),
+		"size":               strconv.FormatInt(u.Size, 10),
+		"mediatype":          mediaType(u.Name),
+		"uploadmediarequest": string(req),
+		"webwx_data_ticket":  w.cookie(host, "webwx_data_ticket"),
+		"pass_ticket":        w.passTicket(),
+	}
+	chunks := int((u.Size + uploadChunkSize - 1) / uploadChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	glog.Infof("Uploading %s (%d bytes) in %d chunks", u.Name, u.Size, chunks)
+	var mediaID string
+	var sent int64
+	buf := make([]byte, uploadChunkSize)
+	for chunk := 0; chunk < chunks; chunk++ {
+		n, err := io.ReadFull(u.Reader, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", fmt.Errorf("error reading %s: %v", u.Name, err)
+		}
+		// The server trusts the size, so a reader that does not match it
+		// would upload a broken file.
+		want := u.Size - sent
+		if want > uploadChunkSize {
+			want = uploadChunkSize
+		}
+		if int64(n) != want {
+			return "", fmt.Errorf("error reading %s: got %d bytes of chunk %d, want %d for the size %d", u.Name, n, chunk, want, u.Size)
+		}
+		if chunks > 1 {
+			fields["chunks"] = strconv.Itoa(chunks)
+			fields["chunk"] = strconv.Itoa(chunk)
+		}
+		var br *BaseResponseJSON
+		err = w.retry(ctx, "UploadMedia", func() error {
+			var err error
+			br, err = w.uploadChunk(ctx, url, fields, u.Name, buf[:n])
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("error uploading chunk %d: %v", chunk, err)
+		}
+		if br.MediaID != "" {
+			mediaID = br.MediaID
+		}
+		sent += int64(n)
+		if u.Progress != nil {
+			u.Progress(sent, u.Size)
+		}
+	}
+	if mediaID == "" {
+		return "", fmt.Errorf("no MediaId after uploading %s", u.Name)
+	}
+	return mediaID, nil
+}
+
+func (w *Wechat) uploadChunk(ctx context.Context, url string, fields map[string]string, name string, data []byte) (*BaseResponseJSON, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			return nil, err
+		}
+	}
+	fw, err := mw.CreateFormFile("filename", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	resp, err := w.doHeader(ctx, "POST", url, http.Header{"Content-Type": {mw.FormDataContentType()}}, &b)
+	if err != nil {
+		return nil, fmt.Errorf("error on POST: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, statusError("webwxuploadmedia", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %v", err)
+	}
+	glog.V(1).Infof("UploadMedia: %s", string(body))
+	br := &BaseResponseJSON{}
+	if err := json.Unmarshal(body, br); err != nil {
+		return nil, fmt.Errorf("error on unmarshal: %v", err)
+	}
+	if br.BaseResponse == nil {
+		return nil, fmt.Errorf("no BaseResponse: %s", string(body))
+	}
+	if br.BaseResponse.Ret != 0 {
+		return nil, retError("webwxuploadmedia", br.BaseResponse)
+	}
+	return br, nil
+}
+
+// SendImage uploads u and sends it as an image.
+func (w *Wechat) SendImage(u *Upload) error {
+	return w.SendImageContext(context.Background(), u)
+}
+
+// SendImageContext is like SendImage but gives up when ctx is done.
+func (w *Wechat) SendImageContext(ctx context.Context, u *Upload) error {
+	mediaID, err := w.UploadMediaContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	msg := &Msg{Type: MsgTypeImage, MediaID: mediaID, ToUserName: u.ToUserName}
+	return w.sendMsg(ctx, "webwxsendmsgimg?fun=async&f=json", msg)
+}
+
+// SendVideo uploads u and sends it as a video.
+func (w *Wechat) SendVideo(u *Upload) error {
+	return w.SendVideoContext(context.Background(), u)
+}
+
+// SendVideoContext is like SendVideo but gives up when ctx is done.
+func (w *Wechat) SendVideoContext(ctx context.Context, u *Upload) error {
+	mediaID, err := w.UploadMediaContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	msg := &Msg{Type: MsgTypeVideo, MediaID: mediaID, ToUserName: u.ToUserName}
+	return w.sendMsg(ctx, "webwxsendvideomsg?fun=async&f=json", msg)
+}
+
+// SendEmoticon uploads u and sends it as an emoticon. u should be a GIF.
+func (w *Wechat) SendEmoticon(u *Upload) error {
+	return w.SendEmoticonContext(context.Background(), u)
+}
+
+// SendEmoticonContext is like SendEmoticon but gives up when ctx is done.
+func (w *Wechat) SendEmoticonContext(ctx context.Context, u *Upload) error {
+	mediaID, err := w.UploadMediaContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	msg := &Msg{Type: MsgTypeEmoticon, MediaID: mediaID, EmojiFlag: 2, ToUserName: u.ToUserName}
+	return w.sendMsg(ctx, "webwxsendemoticon?fun=sys&f=json", msg)
+}
+
+// SendFile uploads u and sends it as a file attachment.
+func (w *Wechat) SendFile(u *Upload) error {
+	return w.SendFileContext(context.Background(), u)
+}
+
+// SendFileContext is like SendFile but gives up when ctx is done.
+func (w *Wechat) SendFileContext(ctx context.Context, u *Upload) error {
+	mediaID, err := w.UploadMediaContext(ctx, u)
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("<appmsg appid='wxeb7ec651dd0aefa9' sdkver=''><title>%s</title>"+
+		"<des></des><action></action><type>%d</type><content></content><url></url><lowurl></lowurl>"+
+		"<appattach><totallen>%d</totallen><attachid>%s</attachid><fileext>%s</fileext></appattach>"+
+		"<extinfo></extinfo></appmsg>",
+		html.EscapeString(u.Name), AppMsgTypeFile, u.Size, mediaID, strings.TrimPrefix(filepath.Ext(u.Name), "."))
+	msg := &Msg{Type: AppMsgTypeFile, Content: content, ToUserName: u.ToUserName}
+	return w.sendMsg(ctx, "webwxsendappmsg?fun=async&f=json", msg)
+}
@@ -0,0 +1,110 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendImage(t *testing.T) {
+	var chunks []string
+	var uploaded int
+	var sent *BaseRequestJSON
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/mmwebwx-bin/webwxuploadmedia":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("ParseMultipartForm failed: %v", err)
+				return
+			}
+			chunks = append(chunks, r.FormValue("chunk")+"/"+r.FormValue("chunks"))
+			if got := r.FormValue("mediatype"); got != "pic" {
+				t.Errorf("mediatype = %s, want pic", got)
+			}
+			f, _, err := r.FormFile("filename")
+			if err != nil {
+				t.Errorf("FormFile failed: %v", err)
+				return
+			}
+			b, _ := ioutil.ReadAll(f)
+			uploaded += len(b)
+			fmt.Fprintf(rw, `{"BaseResponse": {"Ret": 0}, "MediaId": "media%d"}`, len(chunks))
+		case "/cgi-bin/mmwebwx-bin/webwxsendmsgimg":
+			sent = &BaseRequestJSON{}
+			if err := json.NewDecoder(r.Body).Decode(sent); err != nil {
+				t.Errorf("Decode failed: %v", err)
+			}
+			io.WriteString(rw, `{"BaseResponse": {"Ret": 0}}`)
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer srv.Close()
+	w := &Wechat{
+		Client:          NewClient(),
+		baseRequestJSON: &BaseRequestJSON{BaseRequest: &BaseRequest{}},
+		user:            &Member{UserName: "@me"},
+		Endpoints:       &Endpoints{Web: srv.URL, File: srv.URL},
+	}
+	data := bytes.Repeat([]byte("x"), uploadChunkSize+10)
+	var progress []int64
+	u := &Upload{
+		Reader:     bytes.NewReader(data),
+		Size:       int64(len(data)),
+		Name:       "chart.png",
+		ToUserName: "@you",
+		Progress:   func(sent, total int64) { progress = append(progress, sent) },
+	}
+	if err := w.SendImage(u); err != nil {
+		t.Fatalf("SendImage failed: %v", err)
+	}
+	if len(chunks) != 2 || chunks[0] != "0/2" || chunks[1] != "1/2" {
+		t.Errorf("chunks = %v, want [0/2 1/2]", chunks)
+	}
+	if uploaded != len(data) {
+		t.Errorf("uploaded %d bytes, want %d", uploaded, len(data))
+	}
+	if len(progress) != 2 || progress[1] != int64(len(data)) {
+		t.Errorf("progress = %v", progress)
+	}
+	if sent == nil || sent.Msg.MediaID != "media2" || sent.Msg.Type != MsgTypeImage || sent.Msg.ToUserName != "@you" {
+		t.Errorf("sent %+v, want an image with MediaId media2", sent)
+	}
+}
+
+func TestUploadMediaSize(t *testing.T) {
+	uploads := 0
+	c := funcClient(func(method, url string, body io.Reader) (*http.Response, error) {
+		uploads++
+		return newResponse(200, `{"BaseResponse": {"Ret": 0}, "MediaId": "media"}`), nil
+	})
+	w := &Wechat{
+		Client:          c,
+		baseRequestJSON: &BaseRequestJSON{BaseRequest: &BaseRequest{}},
+		user:            &Member{UserName: "@me"},
+		RetryPolicy:     &RetryPolicy{MaxAttempts: 1},
+	}
+	for _, tt := range []struct {
+		data string
+		size int64
+	}{
+		{strings.Repeat("x", uploadChunkSize+10), uploadChunkSize + 20},
+		{strings.Repeat("x", 10), uploadChunkSize + 20},
+		{strings.Repeat("x", 20), 10},
+	} {
+		uploads = 0
+		u := &Upload{Reader: strings.NewReader(tt.data), Size: tt.size, Name: "a.txt", ToUserName: "@you"}
+		if _, err := w.UploadMedia(u); err == nil {
+			t.Errorf("UploadMedia of %d bytes with Size %d succeeded, want error", len(tt.data), tt.size)
+		}
+		if want := int(int64(len(tt.data)) / uploadChunkSize); uploads != want {
+			t.Errorf("uploaded %d chunks of %d bytes with Size %d, want %d", uploads, len(tt.data), tt.size, want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -13,11 +14,8 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"os"
-	"os/exec"
-	"path"
 	"regexp"
-	"runtime"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -27,24 +25,6 @@ import (
 const (
 	// userAgent is Chrome.
 	userAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/61.0.3163.79 Safari/537.36"
-	loginHost = "https://login.weixin.qq.com"
-)
-
-var (
-	syncHosts = map[string][]string{
-		"web.wechat.com": []string{
-			"https://webpush.web.wechat.com",
-			"https://webpush2.wechat.com",
-			"https://webpush.wechat.com",
-		},
-		"wx2.qq.com": []string{
-			"https://webpush.wx2.qq.com",
-		},
-	}
-	webHosts = map[string]string{
-		"web.wechat.com": "https://web.wechat.com",
-		"wx2.qq.com":     "https://wx2.qq.com",
-	}
 )
 
 // NowUnixMilli returns UTC time of milliseconds since.
@@ -65,17 +45,38 @@ type HTTPClient interface {
 	Do(method, url string, body io.Reader) (*http.Response, error)
 }
 
+// ContextHTTPClient is an HTTPClient whose requests can be canceled and
+// carry extra headers. Uploads and video downloads need the headers, e.g.
+// Content-Type and Range. header may be nil.
+type ContextHTTPClient interface {
+	HTTPClient
+	DoContext(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error)
+}
+
 type httpClient struct {
 	c *http.Client
 }
 
+// Jar returns the cookie jar of the underlying http.Client.
+func (hc *httpClient) Jar() http.CookieJar {
+	return hc.c.Jar
+}
+
 func (hc *httpClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return hc.DoContext(context.Background(), method, url, nil, body)
+}
+
+func (hc *httpClient) DoContext(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Add("User-Agent", userAgent)
 	req.Header.Add("Referer", "https://wx.qq.com/")
+	for k, v := range header {
+		req.Header[k] = v
+	}
 	glog.V(1).Infof("Request: %s %s\n", req.Method, req.URL)
 	resp, err := hc.c.Do(req)
 	glog.V(1).Infof("Response: %+v\n", resp)
@@ -112,26 +113,134 @@ func NewClient() HTTPClient {
 
 // Wechat is an instance of wechat ID.
 type Wechat struct {
-	Client          HTTPClient
-	BaseRequestJSON *BaseRequestJSON
-	LoginInfo       *LoginInfo
-	User            *Member
-	AppID           string
-	Contacts        map[string]*Member
-	host            string
+	Client HTTPClient
+	AppID  string
+	// Contacts is created on login and kept up to date afterwards.
+	Contacts *ContactBook
+	// Dedup drops messages seen before, including from a resumed session.
+	// Defaults to NewDedup(0, 0).
+	Dedup *Dedup
+	// contactsMu guards creating Contacts and Dedup.
+	contactsMu sync.Mutex
+	// SessionFile is where the login session is saved. Empty disables it.
+	SessionFile string
+	// QRPresenter shows the login QR code. Defaults to saving QR.jpg.
+	QRPresenter QRPresenter
+	// OnLoginEvent, if set, is called on every login state transition.
+	OnLoginEvent func(*LoginEvent)
+	// MaxQRCodes is how many QR codes to show before giving up. Zero means
+	// keep fetching new ones until one is scanned.
+	MaxQRCodes int
+	// RetryPolicy decides how failed API calls are retried. Defaults to
+	// DefaultRetryPolicy.
+	RetryPolicy *RetryPolicy
+	// AutoRelogin makes Run log in again with Relogin when the session
+	// ends, instead of returning.
+	AutoRelogin bool
+	// Endpoints overrides the hosts derived from where the login redirects
+	// to. Empty fields keep the derived values.
+	Endpoints *Endpoints
+	// The session of the current login. Use CurrentUser and SetSession
+	// from other packages.
+	baseRequestJSON *BaseRequestJSON
+	loginInfo       *LoginInfo
+	user            *Member
+	// host is where the login redirected to, e.g. wx2.qq.com.
+	host string
+	// sessionMu guards the session and host, which a login replaces while
+	// other goroutines may be sending.
+	sessionMu sync.RWMutex
+}
+
+// SetSession sets the session of a login made elsewhere, e.g. a fake one in
+// tests. Login and Resume set it otherwise.
+func (w *Wechat) SetSession(info *LoginInfo, br *BaseRequestJSON, user *Member) {
+	w.sessionMu.Lock()
+	defer w.sessionMu.Unlock()
+	w.loginInfo = info
+	w.baseRequestJSON = br
+	w.user = user
+}
+
+// baseRequest returns the BaseRequest of the current login, or nil.
+func (w *Wechat) baseRequest() *BaseRequest {
+	w.sessionMu.RLock()
+	defer w.sessionMu.RUnlock()
+	if w.baseRequestJSON == nil {
+		return nil
+	}
+	return w.baseRequestJSON.BaseRequest
+}
+
+// CurrentUser returns the logged in user, or nil. It is safe while Run logs
+// in again.
+func (w *Wechat) CurrentUser() *Member {
+	w.sessionMu.RLock()
+	defer w.sessionMu.RUnlock()
+	return w.user
+}
+
+// do sends a request with w.Client, passing ctx along if the client
+// supports it.
+func (w *Wechat) do(ctx context.Context, method, url string, body io.Reader) (*http.Response, error) {
+	return w.doHeader(ctx, method, url, nil, body)
+}
+
+// doHeader is like do but also sends header, which needs a
+// ContextHTTPClient.
+func (w *Wechat) doHeader(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	var err error
+	if c, ok := w.Client.(ContextHTTPClient); ok {
+		resp, err = c.DoContext(ctx, method, url, header, body)
+	} else {
+		if len(header) > 0 {
+			glog.Warningf("%T is not a ContextHTTPClient, so %s %s is sent without the headers %v", w.Client, method, url, header)
+		}
+		resp, err = w.Client.Do(method, url, body)
+	}
+	if err != nil {
+		return nil, &transportError{err}
+	}
+	return resp, nil
+}
+
+// transportError is a request that got no response, e.g. because the
+// connection failed.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+
+func (e *transportError) Unwrap() error { return e.err }
+
+// sleep pauses for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 // getUUID returns the UUID.
-func (w *Wechat) getUUID() (string, error) {
+func (w *Wechat) getUUID(ctx context.Context) (string, error) {
 	url := fmt.Sprintf("%s/jslogin?appid=%s&fun=new&lang=us_EN&_=%d",
-		loginHost, w.AppID, NowUnixMilli())
-	resp, err := w.Client.Do("GET", url, nil)
+		w.endpoints().Login, w.AppID, NowUnixMilli())
+	resp, err := w.do(ctx, "GET", url, nil)
 	if err != nil {
-		return "", fmt.Errorf("error on GET: %v", err)
+		return "", fmt.Errorf("error on GET: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("HTTP status: %s", resp.Status)
+		return "", statusError("jslogin", resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -146,69 +255,42 @@ func (w *Wechat) getUUID() (string, error) {
 	return matches[1], nil
 }
 
-// getQRCode retrieves and saves the QR image to a file.
-func (w *Wechat) getQRCode(uuid string, f *os.File) error {
-	url := fmt.Sprintf("%s/qrcode/%s?t=webwx", loginHost, uuid)
-	resp, err := w.Client.Do("GET", url, nil)
+// getQRCode retrieves the QR image.
+func (w *Wechat) getQRCode(ctx context.Context, uuid string) ([]byte, error) {
+	url := fmt.Sprintf("%s/qrcode/%s?t=webwx", w.endpoints().Login, uuid)
+	resp, err := w.do(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("error on GET: %v", err)
+		return nil, fmt.Errorf("error on GET: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP status: %s", resp.Status)
+		return nil, statusError("qrcode", resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading body: %v", err)
-	}
-	if _, err := f.Write(body); err != nil {
-		return fmt.Errorf("error writing QR image: %v", err)
+		return nil, fmt.Errorf("error reading body: %v", err)
 	}
-	glog.Infof("Successfully save QR image to %s", f.Name())
-	return nil
+	return body, nil
 }
 
-// waitUntilLoggedIn waits until user clicks login or timed out. Returns a redirect_uri.
-func (w *Wechat) waitUntilLoggedIn(uuid string) (string, error) {
-	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/login?uuid=%s&_=%d",
-		loginHost, uuid, NowUnixMilli())
-	re := regexp.MustCompile("window.redirect_uri=\"([^\"]+)\"")
-	const tries = 10
-	for i := 0; i < tries; i++ {
-		resp, err := w.Client.Do("GET", url, nil)
-		if err != nil {
-			glog.Infof("Error on GET: %v", err)
-			continue
-		}
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			glog.Infof("Error reading body: %v", err)
-			continue
-		}
-		glog.V(1).Infof("Body: %s", body)
-		matches := re.FindStringSubmatch(string(body))
-		if len(matches) == 2 {
-			return matches[1], nil
-		}
-	}
-	return "", errors.New("timeout when waiting for user to login")
+// loginURL returns the URL encoded in the QR code for uuid.
+func loginURL(host, uuid string) string {
+	return fmt.Sprintf("%s/l/%s", host, uuid)
 }
 
 // init logs on and returns basic info.
-func (w *Wechat) init(url string) (*BaseRequestJSON, error) {
+func (w *Wechat) init(ctx context.Context, url string) (*BaseRequestJSON, error) {
 	// First access the redirect_uri.
-	resp, err := w.Client.Do("GET", url, nil)
+	resp, err := w.do(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error on GET: %v", err)
+		return nil, fmt.Errorf("error on GET: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Expect 301.
 	if resp.StatusCode != 301 {
-		return nil, fmt.Errorf("HTTP status: %s", resp.Status)
+		return nil, statusError("webwxnewloginpage", resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -235,105 +317,154 @@ func (w *Wechat) init(url string) (*BaseRequestJSON, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal: %v", err)
 	}
-	w.LoginInfo = li
+	w.sessionMu.Lock()
+	w.loginInfo = li
+	w.sessionMu.Unlock()
 	url2 := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxinit?pass_ticket=%s&skey=%s&r=%d",
-		webHosts[w.host], li.PassTicket, li.Skey, NowUnixMilli())
-	resp2, err := w.Client.Do("POST", url2, bytes.NewBuffer(b))
+		w.endpoints().Web, li.PassTicket, li.Skey, NowUnixMilli())
+	resp2, err := w.do(ctx, "POST", url2, bytes.NewBuffer(b))
 	if err != nil {
-		return nil, fmt.Errorf("error on POST: %v", err)
+		return nil, fmt.Errorf("error on POST: %w", err)
 	}
 	defer resp2.Body.Close()
 
+	if resp2.StatusCode != 200 {
+		return nil, statusError("webwxinit", resp2)
+	}
 	body2, err := ioutil.ReadAll(resp2.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading body: %v", err)
 	}
 	glog.V(1).Infof("webwxinit: %s", string(body2))
-	if err := json.Unmarshal(body2, bj); err != nil {
+	ir := &initResponse{}
+	if err := json.Unmarshal(body2, ir); err != nil {
 		return nil, fmt.Errorf("error on unmarshal: %v", err)
 	}
-	return bj, nil
-}
-
-func displayQRCode(path string) {
-	switch runtime.GOOS {
-	case "linux":
-		cmd := exec.Command("xdg-open", path)
-		cmd.Start()
-	case "darwin":
-		cmd := exec.Command("open", path)
-		cmd.Start()
+	if ir.BaseResponse != nil && ir.BaseResponse.Ret != 0 {
+		return nil, retError("webwxinit", ir.BaseResponse)
 	}
+	bj.SyncKey = ir.SyncKey
+	bj.User = ir.User
+	return bj, nil
 }
 
 // Login logs onto the server.
 func (w *Wechat) Login() error {
-	glog.Infof("Getting UUID...")
-	uuid, err := w.getUUID()
-	if err != nil {
-		return fmt.Errorf("error on getUUID(): %v", err)
-	}
-	glog.Infof("UUID: %s", uuid)
+	return w.LoginContext(context.Background())
+}
 
-	glog.Infof("Getting QR code...")
-	f, err := os.Create("QR.jpg")
+// LoginContext is like Login but gives up when ctx is done.
+func (w *Wechat) LoginContext(ctx context.Context) error {
+	rurl, err := w.scanQRCode(ctx)
 	if err != nil {
-		return fmt.Errorf("error on createing QR file: %v", err)
-	}
-	if err := w.getQRCode(uuid, f); err != nil {
-		return fmt.Errorf("error on getting QR code: %v", err)
+		return fmt.Errorf("error on scanning the QR code: %v", err)
 	}
+	return w.finishLogin(ctx, rurl)
+}
 
-	pwd, _ := os.Getwd()
-	glog.Infof("Please scan QR code from you phone:\nfile://%s", path.Join(pwd, f.Name()))
-	displayQRCode(f.Name())
-	rurl, err := w.waitUntilLoggedIn(uuid)
-	if err != nil {
-		return fmt.Errorf("error on scanning the QR code")
-	}
+// finishLogin initializes the session from the redirect_uri of a confirmed
+// login.
+func (w *Wechat) finishLogin(ctx context.Context, rurl string) error {
 	glog.Infof("Got init URL: %s", rurl)
 	u, err := url.Parse(rurl)
 	if err != nil {
 		return fmt.Errorf("error on parsing url: %v", err)
 	}
-	w.host = u.Hostname()
-	glog.Infof("Updated host to %s", w.host)
+	w.sessionMu.Lock()
+	w.host = u.Host
+	w.sessionMu.Unlock()
+	glog.Infof("Updated host to %s", u.Host)
 
 	glog.Infof("Initializing wechat...")
-	w.BaseRequestJSON, err = w.init(rurl)
+	bj, err := w.init(ctx, rurl)
 	if err != nil {
-		return fmt.Errorf("error on init: %v", err)
+		return fmt.Errorf("error on init: %w", err)
 	}
-	glog.Infof("Got BaseRequestJSON: %+v", w.BaseRequestJSON)
+	glog.Infof("Got BaseRequestJSON: %+v", bj)
 	glog.Infof("Login successfully")
+	w.sessionMu.Lock()
+	w.baseRequestJSON = bj
+	if u := bj.User; u != nil {
+		w.user = u
+		bj.User = nil
+		glog.Infof("My account: %+v", u)
+	}
+	w.sessionMu.Unlock()
+	if err := w.SaveSession(); err != nil {
+		glog.Warningf("Failed to save session: %v", err)
+	}
+	w.loadContacts(ctx)
+	return nil
+}
 
+// loadContacts refreshes w.Contacts from the server.
+func (w *Wechat) loadContacts(ctx context.Context) {
 	glog.Infof("Getting contacts...")
-	w.Contacts, err = w.GetContacts()
+	contacts, err := w.GetContactsContext(ctx)
 	if err != nil {
 		glog.Warningf("Failed to get contacts: %v", err)
+		contacts = NewContactBook(nil)
 	}
-	if u := w.BaseRequestJSON.User; u != nil {
-		w.Contacts[u.UserName] = u
-		w.User = u
-		w.BaseRequestJSON.User = nil
-		glog.Infof("My account: %+v", w.User)
+	members := contacts.Members()
+	if u := w.CurrentUser(); u != nil {
+		members = append(members, u)
 	}
-	glog.Infof("Got %d contacts", len(w.Contacts))
-	return nil
+	w.contacts().Reset(members)
+	glog.Infof("Got %d contacts", len(members))
+}
+
+// contacts returns w.Contacts, creating it if needed.
+func (w *Wechat) contacts() *ContactBook {
+	w.contactsMu.Lock()
+	defer w.contactsMu.Unlock()
+	if w.Contacts == nil {
+		w.Contacts = NewContactBook(nil)
+	}
+	return w.Contacts
 }
 
 // GetContacts retrieves contacts.
-func (w *Wechat) GetContacts() (map[string]*Member, error) {
-	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetcontact?r=%d", webHosts[w.host], NowUnixMilli())
-	resp, err := w.Client.Do("POST", url, nil)
+func (w *Wechat) GetContacts() (*ContactBook, error) {
+	return w.GetContactsContext(context.Background())
+}
+
+// GetContactsContext is like GetContacts but gives up when ctx is done.
+func (w *Wechat) GetContactsContext(ctx context.Context) (*ContactBook, error) {
+	var members []*Member
+	seq := 0
+	for {
+		var br *BaseResponseJSON
+		err := w.retry(ctx, "GetContacts", func() error {
+			var err error
+			br, err = w.getContactsHelper(ctx, seq)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, br.MemberList...)
+		glog.Infof("Got %d contacts at seq %d, next seq: %d", len(br.MemberList), seq, br.Seq)
+		if br.Seq == 0 || br.Seq == seq {
+			break
+		}
+		seq = br.Seq
+	}
+	return NewContactBook(members), nil
+}
+
+// getContactsHelper retrieves the page of contacts starting at seq.
+func (w *Wechat) getContactsHelper(ctx context.Context, seq int) (*BaseResponseJSON, error) {
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxgetcontact?r=%d&seq=%d&skey=%s&pass_ticket=%s",
+		w.endpoints().Web, NowUnixMilli(), seq, w.skey(), w.passTicket())
+	resp, err := w.do(ctx, "POST", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error on POST: %v", err)
+		return nil, fmt.Errorf("error on POST: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Expect 301.
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status: %s", resp.Status)
+		return nil, statusError("webwxgetcontact", resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -344,46 +475,66 @@ func (w *Wechat) GetContacts() (map[string]*Member, error) {
 	if err := json.Unmarshal(body, br); err != nil {
 		return nil, fmt.Errorf("error on unmarshal: %v", err)
 	}
-	m := make(map[string]*Member)
-	for _, member := range br.MemberList {
-		m[member.UserName] = member
-		m[member.NickName] = member
+	if br.BaseResponse != nil && br.BaseResponse.Ret != 0 {
+		return nil, retError("webwxgetcontact", br.BaseResponse)
 	}
-	return m, nil
+	return br, nil
 }
 
 // SyncCheck synchronizes with the server.
 func (w *Wechat) SyncCheck() (*SyncRes, error) {
-	syncRes := &SyncRes{}
-	var err error
-	for i := 0; i < 3; i++ {
-		for _, host := range syncHosts[w.host] {
-			glog.Infof("SyncCheck on %s. Attempt: %d", host, i+1)
-			syncRes, err = w.syncCheckHelper(host)
-			if err == nil && syncRes.Retcode == "0" {
-				glog.Infof("Successfully synccheck: %+v", syncRes)
-				return syncRes, nil
+	return w.SyncCheckContext(context.Background())
+}
+
+// SyncCheckContext is like SyncCheck but gives up when ctx is done, including
+// in the middle of the long poll.
+func (w *Wechat) SyncCheckContext(ctx context.Context) (*SyncRes, error) {
+	var syncRes *SyncRes
+	err := w.retry(ctx, "SyncCheck", func() error {
+		var err error
+		for _, host := range w.endpoints().Push {
+			glog.Infof("SyncCheck on %s", host)
+			var sr *SyncRes
+			sr, err = w.syncCheckHelper(ctx, host)
+			if err != nil {
+				glog.Warningf("SyncCheck on %s failed: %v", host, err)
+				continue
+			}
+			syncRes = sr
+			if sr.Retcode == RetcodeOK {
+				glog.Infof("Successfully synccheck: %+v", sr)
+				return nil
 			}
-			glog.Warningf("SyncCheck failed: %+v, %v", syncRes, err)
-			time.Sleep(time.Second)
+			glog.Warningf("SyncCheck on %s: %+v", host, sr)
 		}
+		if syncRes != nil {
+			// A host answered, so there is no point in retrying.
+			return nil
+		}
+		return err
+	})
+	if syncRes == nil {
+		syncRes = &SyncRes{}
 	}
 	return syncRes, err
 }
 
-func (w *Wechat) syncCheckHelper(host string) (*SyncRes, error) {
-	br := w.BaseRequestJSON.BaseRequest
+func (w *Wechat) syncCheckHelper(ctx context.Context, host string) (*SyncRes, error) {
+	w.sessionMu.RLock()
+	br := w.baseRequestJSON.BaseRequest
+	syncKey := w.baseRequestJSON.SyncKey.String()
+	w.sessionMu.RUnlock()
 	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/synccheck?r=%d&sid=%s&uin=%s&skey=%s&deviceid=%s&synckey=%s&_=%d",
-		host, NowUnixMilli(), br.Sid, br.Uin, br.Skey, br.DeviceID, w.BaseRequestJSON.SyncKey.String(), NowUnixMilli())
+		host, NowUnixMilli(), br.Sid, br.Uin, br.Skey, br.DeviceID, syncKey, NowUnixMilli())
 
-	resp, err := w.Client.Do("GET", url, nil)
+	resp, err := w.do(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error on GET: %v", err)
+		return nil, fmt.Errorf("error on GET: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP status: %s", resp.Status)
+		return nil, statusError("synccheck", resp)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -395,41 +546,67 @@ func (w *Wechat) syncCheckHelper(host string) (*SyncRes, error) {
 	if len(matches) != 3 {
 		return nil, fmt.Errorf("invalid response: %s", string(body))
 	}
-	return &SyncRes{Retcode: matches[1], Selector: matches[2]}, nil
+	return &SyncRes{Retcode: Retcode(matches[1]), Selector: Selector(matches[2])}, nil
 }
 
 // WebwxSync retrieves new messages.
 func (w *Wechat) WebwxSync() (*BaseResponseJSON, error) {
+	return w.WebwxSyncContext(context.Background())
+}
+
+// WebwxSyncContext is like WebwxSync but gives up when ctx is done.
+func (w *Wechat) WebwxSyncContext(ctx context.Context) (*BaseResponseJSON, error) {
 	var br *BaseResponseJSON
-	var err error
-	for i := 0; i < 3; i++ {
-		host := webHosts[w.host]
-		glog.Infof("WebwxSync on %s. Attemp: %d", host, i+0)
-		br, err := w.webwxsyncHelper(host)
-		if err == nil {
-			glog.Infof("Successfully WebwxSync: %+v", br.BaseResponse)
-			// Update SyncKey
-			w.BaseRequestJSON.SyncKey = br.SyncCheckKey
-			return br, err
+	err := w.retry(ctx, "WebwxSync", func() error {
+		host := w.endpoints().Web
+		glog.Infof("WebwxSync on %s", host)
+		var err error
+		br, err = w.webwxsyncHelper(ctx, host)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Successfully WebwxSync: %+v", br.BaseResponse)
+	// Update SyncKey
+	w.sessionMu.Lock()
+	w.baseRequestJSON.SyncKey = br.SyncCheckKey
+	w.sessionMu.Unlock()
+	if n := len(br.AddMsgList); n > 0 {
+		br.AddMsgList = w.dropSeen(br.AddMsgList)
+		if d := n - len(br.AddMsgList); d > 0 {
+			glog.Infof("Dropped %d messages seen before", d)
 		}
-		time.Sleep(time.Second)
+		br.AddMsgCount = len(br.AddMsgList)
+	}
+	if err := w.SaveSession(); err != nil {
+		glog.Warningf("Failed to save session: %v", err)
 	}
-	return br, err
+	return br, nil
 }
 
-func (w *Wechat) webwxsyncHelper(host string) (*BaseResponseJSON, error) {
-	w.BaseRequestJSON.RR = NowUnixMilli()
-	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxsync?sid=%s&skey=%s&r=%d", host, w.BaseRequestJSON.BaseRequest.Sid, w.BaseRequestJSON.BaseRequest.Skey, w.BaseRequestJSON.RR)
-	b, err := json.Marshal(w.BaseRequestJSON)
+func (w *Wechat) webwxsyncHelper(ctx context.Context, host string) (*BaseResponseJSON, error) {
+	w.sessionMu.RLock()
+	req := &BaseRequestJSON{
+		BaseRequest: w.baseRequestJSON.BaseRequest,
+		SyncKey:     w.baseRequestJSON.SyncKey,
+		RR:          NowUnixMilli(),
+	}
+	w.sessionMu.RUnlock()
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxsync?sid=%s&skey=%s&r=%d", host, req.BaseRequest.Sid, req.BaseRequest.Skey, req.RR)
+	b, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal: %v", err)
 	}
-	resp, err := w.Client.Do("POST", url, bytes.NewBuffer(b))
+	resp, err := w.do(ctx, "POST", url, bytes.NewBuffer(b))
 	if err != nil {
-		return nil, fmt.Errorf("error on POST: %v", err)
+		return nil, fmt.Errorf("error on POST: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		return nil, statusError("webwxsync", resp)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading body: %v", err)
@@ -439,53 +616,94 @@ func (w *Wechat) webwxsyncHelper(host string) (*BaseResponseJSON, error) {
 	if err := json.Unmarshal(body, br); err != nil {
 		return nil, fmt.Errorf("error on unmarshal: %v", err)
 	}
-	for _, msg := range br.AddMsgList {
-		if n, ok := w.Contacts[msg.FromUserName]; ok {
-			msg.NickName = n.NickName
-		} else {
-			msg.NickName = msg.FromUserName
-		}
+	if br.BaseResponse != nil && br.BaseResponse.Ret != 0 {
+		return nil, retError("webwxsync", br.BaseResponse)
 	}
+	w.updateContacts(br)
+	w.attribute(ctx, br.AddMsgList)
 	return br, nil
 }
 
+// updateContacts applies the modified and deleted contacts in br to
+// w.Contacts.
+func (w *Wechat) updateContacts(br *BaseResponseJSON) {
+	book := w.contacts()
+	for _, m := range br.ModContactList {
+		// Group updates may come without the members.
+		if old := book.Get(m.UserName); old != nil && m.IsGroup() && len(m.MemberList) == 0 {
+			m.MemberList = old.MemberList
+			m.MemberCount = old.MemberCount
+		}
+		book.Add(m)
+	}
+	for _, m := range br.DelContactList {
+		book.Remove(m.UserName)
+	}
+}
+
+// passTicket returns the pass_ticket of the current login, if any.
+func (w *Wechat) passTicket() string {
+	w.sessionMu.RLock()
+	defer w.sessionMu.RUnlock()
+	if w.loginInfo == nil {
+		return ""
+	}
+	return w.loginInfo.PassTicket
+}
+
 // SendMsg sends the given message.
 func (w *Wechat) SendMsg(msg *Msg) error {
+	return w.SendMsgContext(context.Background(), msg)
+}
+
+// SendMsgContext is like SendMsg but gives up when ctx is done.
+func (w *Wechat) SendMsgContext(ctx context.Context, msg *Msg) error {
+	return w.sendMsg(ctx, "webwxsendmsg?fun=async&f=json", msg)
+}
+
+// sendMsg posts msg to endpoint, which is one of the webwxsend* endpoints
+// with its query string.
+func (w *Wechat) sendMsg(ctx context.Context, endpoint string, msg *Msg) error {
 	glog.Infof("Sending messages to %s", msg.ToUserName)
 	msg.ClientMsgID = NowUnixMilli()
 	msg.LocalID = NowUnixMilli()
-	msg.FromUserName = w.User.UserName
+	user, br := w.CurrentUser(), w.baseRequest()
+	if user == nil || br == nil {
+		return errors.New("not logged in")
+	}
+	msg.FromUserName = user.UserName
 	baseJSON := &BaseRequestJSON{
-		BaseRequest: w.BaseRequestJSON.BaseRequest,
+		BaseRequest: br,
 		Msg:         msg,
 		RR:          NowUnixMilli(),
 	}
-	var err error
-	for i := 0; i < 3; i++ {
-		host := webHosts[w.host]
-		glog.Infof("SendMsg on %s. Attemp: %d", host, i+0)
-		err = w.sendMsgHelper(host, baseJSON)
-		if err == nil {
-			glog.Info("Successfully SendMsg")
-			return nil
-		}
-		time.Sleep(time.Second)
+	err := w.retry(ctx, "SendMsg", func() error {
+		host := w.endpoints().Web
+		glog.Infof("SendMsg on %s", host)
+		return w.sendMsgHelper(ctx, host, endpoint, baseJSON)
+	})
+	if err != nil {
+		return err
 	}
-	return err
+	glog.Info("Successfully SendMsg")
+	return nil
 }
 
-func (w *Wechat) sendMsgHelper(host string, baseJSON *BaseRequestJSON) error {
+func (w *Wechat) sendMsgHelper(ctx context.Context, host, endpoint string, baseJSON *BaseRequestJSON) error {
 	b, err := json.Marshal(baseJSON)
 	if err != nil {
 		return fmt.Errorf("failed to marshal: %v", err)
 	}
-	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/webwxsendmsg?pass_ticket=%s", host)
-	resp, err := w.Client.Do("POST", url, bytes.NewBuffer(b))
+	url := fmt.Sprintf("%s/cgi-bin/mmwebwx-bin/%s&pass_ticket=%s", host, endpoint, w.passTicket())
+	resp, err := w.do(ctx, "POST", url, bytes.NewBuffer(b))
 	if err != nil {
-		return fmt.Errorf("error on POST: %v", err)
+		return fmt.Errorf("error on POST: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		return statusError(endpoint, resp)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("error reading body: %v", err)
@@ -495,8 +713,11 @@ func (w *Wechat) sendMsgHelper(host string, baseJSON *BaseRequestJSON) error {
 	if err := json.Unmarshal(body, br); err != nil {
 		return fmt.Errorf("error on unmarshal: %v", err)
 	}
+	if br.BaseResponse == nil {
+		return fmt.Errorf("no BaseResponse: %s", string(body))
+	}
 	if br.BaseResponse.Ret != 0 {
-		return fmt.Errorf("error on sending: %+v", br)
+		return retError(endpoint, br.BaseResponse)
 	}
 	return nil
 }
@@ -1,13 +1,12 @@
 package wechat
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 	"testing"
 	"time"
@@ -34,87 +33,6 @@ func (r *readerCloser) Close() error {
 	return nil
 }
 
-func TestgetUUID(t *testing.T) {
-	w := &Wechat{Client: NewClient()}
-	uuid, err := w.getUUID()
-	if err != nil {
-		t.Fatalf("getUUID failed: %v", err)
-	}
-	if uuid == "" {
-		t.Errorf("Invalid uuid: %s", uuid)
-	}
-	log.Printf("uuid: %s", uuid)
-}
-
-func TestgetQRCode(t *testing.T) {
-	w := &Wechat{Client: NewClient()}
-	uuid, err := w.getUUID()
-	if err != nil {
-		t.Fatalf("getUUID failed: %v", err)
-	}
-	log.Printf("uuid: %s", uuid)
-	tmp, err := ioutil.TempFile("", "QR")
-	if err != nil {
-		t.Fatalf("TempFile failed: %v", err)
-	}
-	defer tmp.Close()
-	if err := w.getQRCode(uuid, tmp); err != nil {
-		t.Errorf("getQRCode failed; %v", err)
-	}
-}
-
-func TestwaitUntilLoggedIn(t *testing.T) {
-	w := &Wechat{Client: NewClient()}
-	uuid, err := w.getUUID()
-	if err != nil {
-		t.Fatalf("getUUID failed: %v", err)
-	}
-	log.Printf("uuid: %s", uuid)
-	tmp, err := ioutil.TempFile("", "QR")
-	if err != nil {
-		t.Fatalf("TempFile failed: %v", err)
-	}
-	defer tmp.Close()
-	defer os.Remove(tmp.Name())
-	if err := w.getQRCode(uuid, tmp); err != nil {
-		t.Fatalf("getQRCode failed; %v", err)
-	}
-	log.Printf("Please scan %s from your phone\n", tmp.Name())
-	uri, err := w.waitUntilLoggedIn(uuid)
-	if err != nil {
-		t.Fatalf("waitUntilLoggedIn failed: %v", err)
-	}
-	log.Printf("uri: %s", uri)
-}
-
-func Testinit(t *testing.T) {
-	w := &Wechat{Client: NewClient()}
-	uuid, err := w.getUUID()
-	if err != nil {
-		t.Fatalf("getUUID failed: %v", err)
-	}
-	log.Printf("uuid: %s", uuid)
-	tmp, err := ioutil.TempFile("", "QR")
-	if err != nil {
-		t.Fatalf("TempFile failed: %v", err)
-	}
-	defer tmp.Close()
-	defer os.Remove(tmp.Name())
-	if err := w.getQRCode(uuid, tmp); err != nil {
-		t.Fatalf("getQRCode failed; %v", err)
-	}
-	log.Printf("Please scan %s from your phone\n", tmp.Name())
-	uri, err := w.waitUntilLoggedIn(uuid)
-	if err != nil {
-		t.Fatalf("waitUntilLoggedIn failed: %v", err)
-	}
-	log.Printf("uri: %s", uri)
-
-	if _, err := w.init(uri); err != nil {
-		t.Fatalf("init failed: %v", err)
-	}
-}
-
 func TestMarshal(t *testing.T) {
 	bj := &BaseRequestJSON{
 		BaseRequest: &BaseRequest{
@@ -174,8 +92,8 @@ func TestSyncCheck(t *testing.T) {
 		},
 		err: nil,
 	}
-	w := &Wechat{Client: c}
-	w.BaseRequestJSON = &BaseRequestJSON{
+	w := &Wechat{Client: c, host: "wx2.qq.com"}
+	w.baseRequestJSON = &BaseRequestJSON{
 		BaseRequest: &BaseRequest{},
 		SyncKey:     &SyncKey{},
 	}
@@ -196,3 +114,35 @@ func TestGenInt(t *testing.T) {
 		log.Printf("%d: %d", i, genInt(i))
 	}
 }
+
+// blockingClient blocks every request until its context is done.
+type blockingClient struct {
+	started chan struct{}
+}
+
+func (b *blockingClient) Do(method, url string, body io.Reader) (*http.Response, error) {
+	return b.DoContext(context.Background(), method, url, nil, body)
+}
+
+func (b *blockingClient) DoContext(ctx context.Context, method, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSyncCheckContextCanceled(t *testing.T) {
+	c := &blockingClient{started: make(chan struct{})}
+	w := &Wechat{Client: c, host: "wx2.qq.com"}
+	w.baseRequestJSON = &BaseRequestJSON{
+		BaseRequest: &BaseRequest{},
+		SyncKey:     &SyncKey{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-c.started
+		cancel()
+	}()
+	if _, err := w.SyncCheckContext(ctx); err != context.Canceled {
+		t.Errorf("SyncCheckContext returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,499 @@
+// Package wechattest provides a fake WeChat web server, so that code using
+// package wechat can be tested offline.
+package wechattest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+// uin is the uin of the fake account.
+const uin = "1000"
+
+// failure is a scripted failure of an endpoint.
+type failure struct {
+	status int
+	ret    int
+}
+
+// Server is a fake WeChat web server. It serves jslogin, qrcode, login
+// polling, the redirect page, webwxinit, webwxgetcontact,
+// webwxbatchgetcontact, synccheck, webwxsync, webwxsendmsg,
+// webwxuploadmedia, webwxsendmsgimg and webwxpushloginurl, and can be scripted to deliver messages, fail requests
+// and end the session.
+type Server struct {
+	*httptest.Server
+	// User is the account that logs in.
+	User *wechat.Member
+	// PageSize is how many contacts webwxgetcontact returns at a time. Zero
+	// returns all of them at once.
+	PageSize int
+	// Hold is how long synccheck waits for something to happen before
+	// answering that nothing did, like the long poll of the real server.
+	Hold time.Duration
+
+	mu       sync.Mutex
+	contacts []*wechat.Member
+	logins   []int
+	uuids    int
+	sessions int
+	sid      string
+	retcode  wechat.Retcode
+	syncKey  int
+	msgs     []*wechat.AddMsg
+	mod      []*wechat.Member
+	del      []*wechat.Member
+	sent     []*wechat.Msg
+	uploads  int
+	failures map[string][]failure
+	requests map[string]int
+	wake     chan struct{}
+}
+
+// NewServer starts a Server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		User:     &wechat.Member{UserName: "@me", NickName: "me"},
+		Hold:     100 * time.Millisecond,
+		retcode:  wechat.RetcodeOK,
+		failures: make(map[string][]failure),
+		requests: make(map[string]int),
+		wake:     make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	s.handle(mux, "/jslogin", "jslogin", s.jslogin)
+	s.handle(mux, "/qrcode/", "qrcode", s.qrcode)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/login", "login", s.login)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxnewloginpage", "webwxnewloginpage", s.newLoginPage)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxpushloginurl", "webwxpushloginurl", s.pushLogin)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxinit", "webwxinit", s.init)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxgetcontact", "webwxgetcontact", s.getContact)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxbatchgetcontact", "webwxbatchgetcontact", s.batchGetContact)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/synccheck", "synccheck", s.syncCheck)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxsync", "webwxsync", s.sync)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxsendmsg", "webwxsendmsg", s.sendMsg)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxuploadmedia", "webwxuploadmedia", s.uploadMedia)
+	s.handle(mux, "/cgi-bin/mmwebwx-bin/webwxsendmsgimg", "webwxsendmsgimg", s.sendMsg)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Endpoints returns the endpoints to point a Wechat at s.
+func (s *Server) Endpoints() *wechat.Endpoints {
+	return &wechat.Endpoints{Login: s.URL, Web: s.URL, Push: []string{s.URL}, File: s.URL}
+}
+
+// NewWechat returns a Wechat ready to log in to s. It does not wait between
+// retries and does not show the QR code.
+func (s *Server) NewWechat() *wechat.Wechat {
+	return &wechat.Wechat{
+		Client:      wechat.NewClient(),
+		Endpoints:   s.Endpoints(),
+		AppID:       "wechattest",
+		QRPresenter: nopPresenter{},
+		RetryPolicy: &wechat.RetryPolicy{MaxAttempts: 3},
+	}
+}
+
+type nopPresenter struct{}
+
+func (nopPresenter) Present(loginURL string, img []byte) error { return nil }
+
+// AddContacts adds members to the contacts returned by webwxgetcontact and
+// webwxbatchgetcontact.
+func (s *Server) AddContacts(members ...*wechat.Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contacts = append(s.contacts, members...)
+}
+
+// ScriptLogin sets the window.code answered by the next login polls, e.g.
+// 201 for scanned, 408 for still waiting and 400 for an expired QR code.
+// Once the script runs out, logins are confirmed with 200.
+func (s *Server) ScriptLogin(codes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins = append(s.logins, codes...)
+}
+
+// Deliver queues msgs for the next webwxsync. Empty MsgIds, ToUserNames and
+// CreateTimes are filled in.
+func (s *Server) Deliver(msgs ...*wechat.AddMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.syncKey++
+		if msg.MsgID == "" {
+			msg.MsgID = strconv.Itoa(1000000 + s.syncKey)
+		}
+		if msg.ToUserName == "" {
+			msg.ToUserName = s.User.UserName
+		}
+		if msg.CreateTime == 0 {
+			msg.CreateTime = time.Now().Unix()
+		}
+		s.msgs = append(s.msgs, msg)
+	}
+	s.notify()
+}
+
+// ModContacts queues modified contacts for the next webwxsync.
+func (s *Server) ModContacts(members ...*wechat.Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mod = append(s.mod, members...)
+	s.notify()
+}
+
+// DelContacts queues deleted contacts for the next webwxsync.
+func (s *Server) DelContacts(members ...*wechat.Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.del = append(s.del, members...)
+	s.notify()
+}
+
+// Logout ends the session. The next synccheck answers rc, e.g.
+// wechat.RetcodeLoginElsewhere, and every other call fails with Ret 1101
+// until the next login.
+func (s *Server) Logout(rc wechat.Retcode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sid = ""
+	s.retcode = rc
+	s.notify()
+}
+
+// Fail makes the next request to endpoint, e.g. "webwxsendmsg", fail. A
+// status other than 200 is answered as is, and otherwise the BaseResponse
+// has the given Ret. Repeated calls fail that many requests.
+func (s *Server) Fail(endpoint string, status, ret int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failure{status, ret})
+}
+
+// Sent returns the messages sent with webwxsendmsg and webwxsendmsgimg so
+// far.
+func (s *Server) Sent() []*wechat.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*wechat.Msg(nil), s.sent...)
+}
+
+// Requests returns how many requests endpoint got so far.
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// notify wakes up the pending synccheck. s.mu must be held.
+func (s *Server) notify() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// handle registers h for pattern, counting the requests and serving the
+// scripted failures of endpoint first.
+func (s *Server) handle(mux *http.ServeMux, pattern, endpoint string, h http.HandlerFunc) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[endpoint]++
+		var f *failure
+		if fs := s.failures[endpoint]; len(fs) > 0 {
+			f = &fs[0]
+			s.failures[endpoint] = fs[1:]
+		}
+		s.mu.Unlock()
+		switch {
+		case f == nil:
+			h(w, r)
+		case f.status != http.StatusOK:
+			http.Error(w, http.StatusText(f.status), f.status)
+		default:
+			writeJSON(w, map[string]interface{}{"BaseResponse": &wechat.BaseResponse{Ret: f.ret, ErrMsg: "scripted failure"}})
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// expired is the BaseResponse for requests without a valid session.
+var expired = map[string]interface{}{"BaseResponse": &wechat.BaseResponse{Ret: 1101}}
+
+// valid returns whether sid and skey belong to the current session. s.mu
+// must be held.
+func (s *Server) valid(sid, skey string) bool {
+	return s.sid != "" && sid == s.sid && skey == s.skey()
+}
+
+func (s *Server) skey() string {
+	return fmt.Sprintf("@crypt_%d", s.sessions)
+}
+
+func (s *Server) jslogin(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.uuids++
+	uuid := fmt.Sprintf("uuid-%d", s.uuids)
+	s.mu.Unlock()
+	fmt.Fprintf(w, `window.QRLogin.code = 200; window.QRLogin.uuid = "%s";`, uuid)
+}
+
+func (s *Server) qrcode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/jpeg")
+	fmt.Fprint(w, "fake QR code")
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	code := http.StatusOK
+	if len(s.logins) > 0 {
+		code = s.logins[0]
+		s.logins = s.logins[1:]
+	}
+	s.mu.Unlock()
+	switch code {
+	case http.StatusOK:
+		fmt.Fprintf(w, "window.code=200;\nwindow.redirect_uri=\"%s/cgi-bin/mmwebwx-bin/webwxnewloginpage?ticket=ticket&uuid=%s&lang=en_US&scan=%d\";",
+			s.URL, url.QueryEscape(r.FormValue("uuid")), time.Now().Unix())
+	case http.StatusCreated:
+		fmt.Fprint(w, "window.code=201;window.userAvatar = 'data:img/jpg;base64,';")
+	default:
+		fmt.Fprintf(w, "window.code=%d;", code)
+	}
+}
+
+func (s *Server) newLoginPage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.sessions++
+	s.sid = fmt.Sprintf("sid-%d", s.sessions)
+	s.retcode = wechat.RetcodeOK
+	sid, skey, ticket := s.sid, s.skey(), fmt.Sprintf("ticket-%d", s.sessions)
+	s.mu.Unlock()
+	for _, c := range []*http.Cookie{
+		{Name: "wxsid", Value: sid},
+		{Name: "wxuin", Value: uin},
+		{Name: "webwx_data_ticket", Value: ticket},
+	} {
+		c.Path = "/"
+		http.SetCookie(w, c)
+	}
+	w.WriteHeader(http.StatusMovedPermanently)
+	fmt.Fprintf(w, "<error><ret>0</ret><message></message><skey>%s</skey><wxsid>%s</wxsid><wxuin>%s</wxuin><pass_ticket>%s</pass_ticket><isgrayscale>1</isgrayscale></error>",
+		skey, sid, uin, ticket)
+}
+
+func (s *Server) pushLogin(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("uin") != uin {
+		writeJSON(w, map[string]string{"ret": "1", "msg": "unknown uin"})
+		return
+	}
+	s.mu.Lock()
+	s.uuids++
+	uuid := fmt.Sprintf("uuid-%d", s.uuids)
+	s.mu.Unlock()
+	writeJSON(w, map[string]string{"ret": "0", "msg": "all ok", "uuid": uuid})
+}
+
+// readRequest decodes the BaseRequestJSON in the body of r.
+func readRequest(r *http.Request) *wechat.BaseRequestJSON {
+	req := &wechat.BaseRequestJSON{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.BaseRequest == nil {
+		req.BaseRequest = &wechat.BaseRequest{}
+	}
+	return req
+}
+
+// currentSyncKey returns the current SyncKey. s.mu must be held.
+func (s *Server) currentSyncKey() *wechat.SyncKey {
+	return &wechat.SyncKey{Count: 1, List: []map[string]int{{"Key": 1, "Val": s.syncKey}}}
+}
+
+func (s *Server) init(w http.ResponseWriter, r *http.Request) {
+	req := readRequest(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(req.BaseRequest.Sid, req.BaseRequest.Skey) {
+		writeJSON(w, expired)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"BaseResponse": &wechat.BaseResponse{},
+		"User":         s.User,
+		"SyncKey":      s.currentSyncKey(),
+	})
+}
+
+func (s *Server) getContact(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sid == "" || r.FormValue("skey") != s.skey() {
+		writeJSON(w, expired)
+		return
+	}
+	seq, _ := strconv.Atoi(r.FormValue("seq"))
+	if seq > len(s.contacts) {
+		seq = len(s.contacts)
+	}
+	end := len(s.contacts)
+	if s.PageSize > 0 && seq+s.PageSize < end {
+		end = seq + s.PageSize
+	}
+	next := end
+	if end == len(s.contacts) {
+		next = 0
+	}
+	writeJSON(w, &wechat.BaseResponseJSON{
+		BaseResponse: &wechat.BaseResponse{},
+		MemberList:   s.contacts[seq:end],
+		Seq:          next,
+	})
+}
+
+func (s *Server) batchGetContact(w http.ResponseWriter, r *http.Request) {
+	req := &struct {
+		BaseRequest *wechat.BaseRequest
+		List        []*wechat.Member
+	}{BaseRequest: &wechat.BaseRequest{}}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(req.BaseRequest.Sid, req.BaseRequest.Skey) {
+		writeJSON(w, expired)
+		return
+	}
+	br := &wechat.BaseResponseJSON{BaseResponse: &wechat.BaseResponse{}}
+	for _, want := range req.List {
+		for _, m := range s.contacts {
+			if m.UserName == want.UserName {
+				br.ContactList = append(br.ContactList, m)
+			}
+		}
+	}
+	writeJSON(w, br)
+}
+
+// selector returns the synccheck selector for what is queued. s.mu must be
+// held.
+func (s *Server) selector() wechat.Selector {
+	switch {
+	case len(s.msgs) > 0:
+		return wechat.SelectorNewMsg
+	case len(s.mod) > 0 || len(s.del) > 0:
+		return wechat.SelectorModContact
+	}
+	return wechat.SelectorNone
+}
+
+func (s *Server) syncCheck(w http.ResponseWriter, r *http.Request) {
+	answer := func() (wechat.Retcode, wechat.Selector, bool) {
+		switch {
+		case r.FormValue("sid") == s.sid && s.sid != "" && r.FormValue("skey") == s.skey():
+			sel := s.selector()
+			return wechat.RetcodeOK, sel, sel != wechat.SelectorNone
+		case s.retcode != wechat.RetcodeOK:
+			return s.retcode, wechat.SelectorNone, true
+		}
+		return wechat.RetcodeLoginElsewhere, wechat.SelectorNone, true
+	}
+	s.mu.Lock()
+	rc, sel, done := answer()
+	wake := s.wake
+	s.mu.Unlock()
+	if !done {
+		t := time.NewTimer(s.Hold)
+		defer t.Stop()
+		select {
+		case <-wake:
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+		s.mu.Lock()
+		rc, sel, _ = answer()
+		s.mu.Unlock()
+	}
+	fmt.Fprintf(w, `window.synccheck={retcode:"%s",selector:"%s"}`, rc, sel)
+}
+
+func (s *Server) sync(w http.ResponseWriter, r *http.Request) {
+	req := readRequest(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(req.BaseRequest.Sid, req.BaseRequest.Skey) {
+		writeJSON(w, expired)
+		return
+	}
+	br := &wechat.BaseResponseJSON{
+		BaseResponse:   &wechat.BaseResponse{},
+		AddMsgCount:    len(s.msgs),
+		AddMsgList:     s.msgs,
+		ModContactList: s.mod,
+		DelContactList: s.del,
+		SyncCheckKey:   s.currentSyncKey(),
+	}
+	s.msgs, s.mod, s.del = nil, nil, nil
+	writeJSON(w, br)
+}
+
+func (s *Server) sendMsg(w http.ResponseWriter, r *http.Request) {
+	req := readRequest(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(req.BaseRequest.Sid, req.BaseRequest.Skey) {
+		writeJSON(w, expired)
+		return
+	}
+	if req.Msg == nil || !strings.HasPrefix(req.Msg.ToUserName, "@") {
+		writeJSON(w, map[string]interface{}{"BaseResponse": &wechat.BaseResponse{Ret: 1, ErrMsg: "invalid message"}})
+		return
+	}
+	s.sent = append(s.sent, req.Msg)
+	writeJSON(w, map[string]interface{}{
+		"BaseResponse": &wechat.BaseResponse{},
+		"MsgID":        strconv.Itoa(2000000 + len(s.sent)),
+		"LocalID":      strconv.Itoa(req.Msg.LocalID),
+	})
+}
+
+func (s *Server) uploadMedia(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &wechat.BaseRequestJSON{BaseRequest: &wechat.BaseRequest{}}
+	json.Unmarshal([]byte(r.FormValue("uploadmediarequest")), req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(req.BaseRequest.Sid, req.BaseRequest.Skey) {
+		writeJSON(w, expired)
+		return
+	}
+	if _, _, err := r.FormFile("filename"); err != nil {
+		writeJSON(w, map[string]interface{}{"BaseResponse": &wechat.BaseResponse{Ret: 1, ErrMsg: "no file"}})
+		return
+	}
+	s.uploads++
+	writeJSON(w, map[string]interface{}{
+		"BaseResponse": &wechat.BaseResponse{},
+		"MediaId":      fmt.Sprintf("media-%d", s.uploads),
+	})
+}
@@ -0,0 +1,269 @@
+package wechattest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/huangw5/webwx/wechat"
+)
+
+// login returns a Wechat logged in to s.
+func login(t *testing.T, s *Server) *wechat.Wechat {
+	w := s.NewWechat()
+	if err := w.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return w
+}
+
+// next returns the next event, failing the test after a while.
+func next(t *testing.T, events <-chan *wechat.Event) *wechat.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event")
+		return nil
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.PageSize = 2
+	s.AddContacts(
+		&wechat.Member{UserName: "@alice", NickName: "Alice"},
+		&wechat.Member{UserName: "@bob", NickName: "Bob"},
+		&wechat.Member{UserName: "@@group", NickName: "Group"},
+	)
+	s.ScriptLogin(400, 408, 201, 200)
+
+	w := s.NewWechat()
+	var states []wechat.LoginState
+	w.OnLoginEvent = func(e *wechat.LoginEvent) { states = append(states, e.State) }
+	if err := w.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	want := []wechat.LoginState{
+		wechat.LoginWaiting, wechat.LoginExpired,
+		wechat.LoginWaiting, wechat.LoginTimeout, wechat.LoginScanned, wechat.LoginConfirmed,
+	}
+	if len(states) != len(want) {
+		t.Fatalf("login states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("login states = %v, want %v", states, want)
+			break
+		}
+	}
+	if u := w.CurrentUser(); u == nil || u.UserName != "@me" {
+		t.Errorf("CurrentUser() = %+v, want @me", u)
+	}
+	if got := s.Requests("jslogin"); got != 2 {
+		t.Errorf("jslogin requests = %d, want 2", got)
+	}
+	if got := s.Requests("webwxgetcontact"); got != 2 {
+		t.Errorf("webwxgetcontact requests = %d, want 2 pages", got)
+	}
+	// The contacts and the user.
+	if got := w.Contacts.Len(); got != 4 {
+		t.Errorf("got %d contacts, want 4", got)
+	}
+	if m, err := w.Contacts.Lookup("Bob"); err != nil || m.UserName != "@bob" {
+		t.Errorf("Lookup(Bob) = %+v, %v, want @bob", m, err)
+	}
+}
+
+func TestRunAndSend(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddContacts(&wechat.Member{UserName: "@alice", NickName: "Alice"})
+	w := login(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *wechat.Event)
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx, events) }()
+
+	s.Deliver(&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@alice", Content: "hi"})
+	e := next(t, events)
+	if e.Type != wechat.MessageEvent || e.Msg.Content != "hi" || e.Msg.NickName != "Alice" {
+		t.Errorf("got %+v, want a message from Alice", e)
+	}
+
+	s.ModContacts(&wechat.Member{UserName: "@carol", NickName: "Carol"})
+	if e := next(t, events); e.Type != wechat.ContactEvent || len(e.ModContacts) != 1 {
+		t.Errorf("got %+v, want a contact event", e)
+	}
+	if w.Contacts.Get("@carol") == nil {
+		t.Errorf("@carol was not added to the contacts")
+	}
+
+	if err := w.SendMsg(&wechat.Msg{Type: wechat.MsgTypeText, Content: "hello", ToUserName: "@alice"}); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	sent := s.Sent()
+	if len(sent) != 1 || sent[0].Content != "hello" || sent[0].FromUserName != "@me" {
+		t.Errorf("sent %+v, want hello from @me", sent)
+	}
+
+	s.Logout(wechat.RetcodeLoginElsewhere)
+	if e := next(t, events); e.Type != wechat.LogoutEvent {
+		t.Errorf("got %+v, want a logout event", e)
+	}
+	if err := <-done; !errors.Is(err, wechat.ErrLoginElsewhere) {
+		t.Errorf("Run returned %v, want ErrLoginElsewhere", err)
+	}
+}
+
+func TestAutoRelogin(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	w := login(t, s)
+	w.AutoRelogin = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *wechat.Event)
+	go w.Run(ctx, events)
+
+	// Sending while Run logs in again must not race with it. Sends may
+	// fail until the new session is up.
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for ctx.Err() == nil {
+			w.SendMsgContext(ctx, &wechat.Msg{Type: wechat.MsgTypeText, Content: "hi", ToUserName: "@alice"})
+			w.CurrentUser()
+		}
+	}()
+	defer func() {
+		cancel()
+		<-sending
+	}()
+
+	s.Logout(wechat.RetcodeLoggedOut)
+	if e := next(t, events); e.Type != wechat.LogoutEvent {
+		t.Fatalf("got %+v, want a logout event", e)
+	}
+	if e := next(t, events); e.Type != wechat.ReloginEvent {
+		t.Fatalf("got %+v, want a relogin event", e)
+	}
+	if got := s.Requests("webwxpushloginurl"); got != 1 {
+		t.Errorf("webwxpushloginurl requests = %d, want 1", got)
+	}
+	s.Deliver(&wechat.AddMsg{MsgType: wechat.MsgTypeText, FromUserName: "@alice", Content: "back"})
+	if e := next(t, events); e.Type != wechat.MessageEvent || e.Msg.Content != "back" {
+		t.Errorf("got %+v, want the message after the relogin", e)
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	w := login(t, s)
+	msg := &wechat.Msg{Type: wechat.MsgTypeText, Content: "hi", ToUserName: "@alice"}
+
+	s.Fail("webwxsendmsg", 503, 0)
+	s.Fail("webwxsendmsg", 200, 1205)
+	if err := w.SendMsg(msg); err != nil {
+		t.Errorf("SendMsg: %v, want success after retrying", err)
+	}
+
+	s.Fail("webwxsendmsg", 200, 1101)
+	err := w.SendMsg(msg)
+	if !errors.Is(err, wechat.ErrSessionExpired) {
+		t.Errorf("SendMsg returned %v, want ErrSessionExpired", err)
+	}
+	var apiErr *wechat.APIError
+	if !errors.As(err, &apiErr) || apiErr.Endpoint != "webwxsendmsg" || apiErr.Ret != 1101 {
+		t.Errorf("SendMsg returned %#v, want an APIError of webwxsendmsg", err)
+	}
+
+	s.Logout(wechat.RetcodeSessionInvalid)
+	if _, err := w.GetContacts(); !errors.Is(err, wechat.ErrSessionExpired) {
+		t.Errorf("GetContacts after logout returned %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := NewServer()
+	s.AddContacts(&wechat.Member{UserName: "@alice", NickName: "Alice"})
+	var recording bytes.Buffer
+	w := s.NewWechat()
+	w.Client = wechat.NewRecorder(w.Client, &recording)
+	if err := w.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	msg := &wechat.Msg{Type: wechat.MsgTypeText, Content: "hi", ToUserName: "@alice"}
+	if err := w.SendMsg(msg); err != nil {
+		t.Fatalf("SendMsg: %v", err)
+	}
+	s.Close()
+
+	exchanges, err := wechat.ReadExchanges(&recording)
+	if err != nil {
+		t.Fatalf("ReadExchanges: %v", err)
+	}
+	r := wechat.NewReplayer(exchanges)
+	w = s.NewWechat()
+	w.Client = r
+	if err := w.Login(); err != nil {
+		t.Fatalf("Login from the recording: %v", err)
+	}
+	if u := w.CurrentUser(); u.UserName != "@me" || w.Contacts.Get("@alice") == nil {
+		t.Errorf("got user %+v and contacts %+v, want the recorded ones", u, w.Contacts.Members())
+	}
+	if err := w.SendMsg(msg); err != nil {
+		t.Errorf("SendMsg from the recording: %v", err)
+	}
+	if n := r.Remaining(); n != 0 {
+		t.Errorf("%d exchanges were not replayed", n)
+	}
+}
+
+func TestRecordUpload(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	var recording bytes.Buffer
+	w := s.NewWechat()
+	w.Client = wechat.NewRecorder(w.Client, &recording)
+	if err := w.Login(); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	img := []byte("\xff\xd8\xff\xe0 not UTF-8")
+	u := &wechat.Upload{Reader: bytes.NewReader(img), Size: int64(len(img)), Name: "a.jpg", ToUserName: "@alice"}
+	if err := w.SendImage(u); err != nil {
+		t.Fatalf("SendImage: %v", err)
+	}
+	if sent := s.Sent(); len(sent) != 1 || sent[0].MediaID != "media-1" {
+		t.Errorf("sent %+v, want the uploaded image", sent)
+	}
+
+	exchanges, err := wechat.ReadExchanges(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadExchanges: %v", err)
+	}
+	uploaded := false
+	for _, e := range exchanges {
+		if strings.Contains(e.URL, "webwxuploadmedia") && e.Request != nil && e.Request.Base64 != "" {
+			uploaded = true
+		}
+		for _, b := range []string{recording.String(), string(e.Request.Bytes()), string(e.Response.Bytes())} {
+			for _, secret := range []string{"sid-1", "@crypt_1", "ticket-1"} {
+				if strings.Contains(b, secret) {
+					t.Errorf("recording of %s has %q", e.URL, secret)
+				}
+			}
+		}
+	}
+	if !uploaded {
+		t.Errorf("recording has no binary upload")
+	}
+}